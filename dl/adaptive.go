@@ -0,0 +1,134 @@
+package dl
+
+import (
+	"sync"
+	"time"
+)
+
+// SetAdaptiveConcurrency lets the number of workers move between min and max
+// during the download, starting from the concurrency given to Start or Record:
+// one more worker after a window of successful segments whose throughput did
+// not drop, half of them after a failure worth retrying (e.g. 429, 5xx, timeout).
+func (d *Downloader) SetAdaptiveConcurrency(min int, max int) {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	d.workers.lock.Lock()
+	defer d.workers.lock.Unlock()
+	d.workers.adaptive = true
+	d.workers.min = min
+	d.workers.max = max
+}
+
+/*并发名额，自适应时按AIMD调整上限*/
+type workerLimit struct {
+	lock     sync.Mutex
+	adaptive bool
+	min      int
+	max      int
+	limit    int
+	active   int
+
+	/*当前窗口: 连续成功的分片数、字节数与起始时间*/
+	successes int
+	bytes     int64
+	start     time.Time
+	lastRate  float64 // bytes per second of the previous window
+	decreased time.Time
+}
+
+/*开始执行前设置并发数，至少为1，自适应时限制在[min, max]内*/
+func (w *workerLimit) init(concurrency int) {
+	if concurrency < 1 {
+		/*名额为0时没有分片能执行，run会一直等待*/
+		concurrency = 1
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.adaptive && w.limit > 0 {
+		/*直播录制多次执行时沿用调整后的并发数*/
+		return
+	}
+	w.limit = concurrency
+	if w.adaptive {
+		if w.limit < w.min {
+			w.limit = w.min
+		}
+		if w.limit > w.max {
+			w.limit = w.max
+		}
+	}
+	w.resetWindow()
+}
+
+/*占用一个名额，已达上限时返回false*/
+func (w *workerLimit) acquire() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.active >= w.limit {
+		return false
+	}
+	w.active++
+	return true
+}
+
+func (w *workerLimit) release() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.active--
+}
+
+/*当前并发数，非自适应时返回0*/
+func (w *workerLimit) level() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.adaptive {
+		return 0
+	}
+	return w.limit
+}
+
+/*分片成功：窗口内成功数达到并发数时，吞吐未下降则加1*/
+func (w *workerLimit) succeeded(n int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.adaptive {
+		return
+	}
+	w.successes++
+	w.bytes += n
+	if w.successes < w.limit {
+		return
+	}
+	rate := float64(w.bytes) / time.Since(w.start).Seconds()
+	if rate >= w.lastRate*0.9 && w.limit < w.max {
+		w.limit++
+	}
+	w.lastRate = rate
+	w.resetWindow()
+}
+
+/*分片失败：减半；减少之前已发出的请求再失败时不重复减少*/
+func (w *workerLimit) failed(started time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.adaptive || started.Before(w.decreased) {
+		return
+	}
+	w.limit /= 2
+	if w.limit < w.min {
+		w.limit = w.min
+	}
+	w.decreased = time.Now()
+	w.lastRate = 0
+	w.resetWindow()
+}
+
+func (w *workerLimit) resetWindow() {
+	w.successes = 0
+	w.bytes = 0
+	w.start = time.Now()
+}
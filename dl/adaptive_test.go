@@ -0,0 +1,150 @@
+package dl
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerLimit(t *testing.T) {
+	w := &workerLimit{adaptive: true, min: 2, max: 4}
+	w.init(3)
+	for i := 0; i < 3; i++ {
+		if !w.acquire() {
+			t.Fatalf("expected worker %d to be acquired", i)
+		}
+	}
+	if w.acquire() {
+		t.Fatal("expected limit of 3 workers")
+	}
+
+	/*一个窗口(3个分片)成功后加1，不超过max*/
+	for i := 0; i < 3; i++ {
+		w.succeeded(1000)
+	}
+	if w.level() != 4 {
+		t.Fatalf("expected 4 workers, result: %d", w.level())
+	}
+	for i := 0; i < 8; i++ {
+		w.succeeded(1000)
+	}
+	if w.level() != 4 {
+		t.Fatalf("expected at most 4 workers, result: %d", w.level())
+	}
+
+	/*失败时减半，减少之前发出的请求再失败不重复减少，不低于min*/
+	started := time.Now()
+	w.failed(started)
+	w.failed(started)
+	if w.level() != 2 {
+		t.Fatalf("expected 2 workers, result: %d", w.level())
+	}
+	w.failed(time.Now())
+	if w.level() != 2 {
+		t.Fatalf("expected at least 2 workers, result: %d", w.level())
+	}
+
+	fixed := &workerLimit{}
+	fixed.init(5)
+	fixed.failed(time.Now())
+	if fixed.level() != 0 || fixed.limit != 5 {
+		t.Fatalf("expected fixed limit of 5, result: %d", fixed.limit)
+	}
+
+	/*并发数小于1时按1执行*/
+	single := &workerLimit{}
+	single.init(0)
+	if !single.acquire() || single.acquire() {
+		t.Fatalf("expected a single worker, result: %d", single.limit)
+	}
+}
+
+func TestStartZeroConcurrency(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\n0.ts\n#EXTINF:10,\n1.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		w.Write(tsPacket(0))
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Start(0, false, 1)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start(0) did not finish")
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n"
+	for i := 0; i < 30; i++ {
+		playlist += fmt.Sprintf("#EXTINF:10,\n%d.ts\n", i)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	/*并发超过3时返回429*/
+	var lock sync.Mutex
+	active := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, playlist)
+			return
+		}
+		lock.Lock()
+		active++
+		busy := active > 3
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			active--
+			lock.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond)
+		if busy {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write(tsPacket(0))
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetRetryBackoff(time.Millisecond, 5*time.Millisecond)
+	d.SetAdaptiveConcurrency(1, 8)
+	var levels []int
+	d.Subscribe(ObserverFunc(func(e Event) {
+		if e.Type == EventSegmentFinished || e.Type == EventSegmentRetried {
+			lock.Lock()
+			levels = append(levels, e.Workers)
+			lock.Unlock()
+		}
+	}))
+	if err := d.Start(8, false, -1); err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range levels {
+		if level < 1 || level > 8 {
+			t.Fatalf("worker level %d out of [1, 8]", level)
+		}
+	}
+	if last := levels[len(levels)-1]; last >= 8 {
+		t.Fatalf("expected fewer workers after 429 responses, result: %d", last)
+	}
+}
@@ -2,16 +2,22 @@ package dl
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/anlaneg/m3u8/parse"
 	"github.com/anlaneg/m3u8/tool"
+	"github.com/anlaneg/m3u8/ts"
 	"strings"
 )
 
@@ -20,13 +26,24 @@ const (
 	tsFolderName        = "ts"
 	mergeTSFilename     = "main.ts"
 	finishStateFileName = ".finished"
-	tsTempFileSuffix    = "_tmp"
+	tsTempFileSuffix    = "_tmp"  // raw content of a segment being downloaded
+	tsDecodeFileSuffix  = "_part" // decrypted content before renaming
 	progressWidth       = 40
 )
 
+// Format of the download output
+type Format string
+
+const (
+	FormatTS  Format = "ts"  // all segments merged into a single .ts file
+	FormatHLS Format = "hls" // segments kept in ts folder, played through a local index.m3u8
+	FormatMP4 Format = "mp4" // segments remuxed into a single .mp4 file
+)
+
 type FileSlice struct {
 	segId int
 	tries int
+	ready time.Time // not retried before
 }
 
 type Downloader struct {
@@ -36,16 +53,36 @@ type Downloader struct {
 	tsFolder string
 	finish   int32
 	segLen   int
+	nextSeq  uint64 // next media sequence to record in live mode
 
 	result      *parse.Result
+	client      *tool.Client
 	fileName    string
 	finishState *FinishState
+
+	format        Format
+	keepEncrypted bool // store segments as downloaded, only with FormatHLS
+	allowGaps     bool // write the output even if segments are missing
+
+	observers []Observer
+	bytes     int64 // bytes of the finished segments
+	failErr   error // last error of the segments given up
+
+	retryBase time.Duration
+	retryMax  time.Duration
+	wake      chan struct{} // a segment is queued or done
+	workers   workerLimit
 }
 
 // NewTask returns a Task instance
 func NewTask(output string, url string) (*Downloader, error) {
+	return NewTaskWithOptions(output, url, nil)
+}
+
+// NewTaskWithOptions returns a Task instance, opt controls how the playlist is resolved
+func NewTaskWithOptions(output string, url string, opt *parse.Options) (*Downloader, error) {
 	/*请求url,并获得result*/
-	result, err := parse.FromURL(url)
+	result, err := parse.FromURLWithOptions(url, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -73,12 +110,25 @@ func NewTask(output string, url string) (*Downloader, error) {
 		return nil, fmt.Errorf("create ts folder '[%s]' failed: %s", tsFolder, err.Error())
 	}
 
+	/*分片请求共用client的限速，client未设置时使用自己的Limiter，以便运行中调整*/
+	client := opt.HTTPClient()
+	if client.Limiter == nil {
+		c := *client
+		c.Limiter = tool.NewLimiter(0)
+		client = &c
+	}
+
 	/*构造downloader*/
 	d := &Downloader{
 		folder:      folder,
 		tsFolder:    tsFolder,
 		result:      result,
+		client:      client,
 		finishState: nil,
+		format:      FormatTS,
+		retryBase:   defaultRetryBase,
+		retryMax:    defaultRetryMax,
+		wake:        make(chan struct{}, 1),
 	}
 
 	/*加载finish状态*/
@@ -87,6 +137,10 @@ func NewTask(output string, url string) (*Downloader, error) {
 		return nil, fmt.Errorf("load finish state '[%s]' failed: %s", filepath.Join(tsFolder, finishStateFileName), err.Error())
 	}
 	d.finishState = state
+	/*按身份核对此前完成的分片，playlist变化时只重新下载受影响的分片*/
+	if err := d.verifyFinishState(); err != nil {
+		return nil, fmt.Errorf("verify finish state '[%s]' failed: %s", filepath.Join(tsFolder, finishStateFileName), err.Error())
+	}
 
 	/*指明总分片数*/
 	d.segLen = len(result.M3u8.Segments)
@@ -96,45 +150,161 @@ func NewTask(output string, url string) (*Downloader, error) {
 	return d, nil
 }
 
-// Start runs downloader
+// Start runs downloader, concurrency below 1 runs a single worker
 func (d *Downloader) Start(concurrency int, continueFlag bool, maxTries int) error {
+	return d.StartContext(context.Background(), concurrency, continueFlag, maxTries)
+}
+
+// StartContext runs downloader until all segments are done or ctx is cancelled.
+// On cancellation no new segment is dispatched, in-flight requests are aborted,
+// the finish state is flushed so that a later run with continueFlag resumes,
+// and ctx.Err() is returned without producing the output.
+func (d *Downloader) StartContext(ctx context.Context, concurrency int, continueFlag bool, maxTries int) error {
+	start := time.Now()
+	err := d.start(ctx, concurrency, continueFlag, maxTries)
+	d.emitFinished(d.outputPath(), start, err)
+	return err
+}
+
+func (d *Downloader) start(ctx context.Context, concurrency int, continueFlag bool, maxTries int) error {
+	if err := d.dropMismatchedEncryption(); err != nil {
+		return fmt.Errorf("verify finish state '[%s]' failed: %s", filepath.Join(d.tsFolder, finishStateFileName), err.Error())
+	}
+	if err := d.run(ctx, concurrency, continueFlag, maxTries); err != nil {
+		return err
+	}
+	/*任务完成，按输出格式执行merge*/
+	switch d.format {
+	case FormatHLS:
+		return d.writeHLS()
+	case FormatMP4:
+		return d.remux()
+	}
+	if err := d.merge(); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*通知任务结束，出错时只提供缺失分片但已写出的输出路径*/
+func (d *Downloader) emitFinished(output string, start time.Time, err error) {
+	if err != nil {
+		output = ""
+		var incomplete *IncompleteError
+		if errors.As(err, &incomplete) {
+			output = incomplete.Output
+		}
+	}
+	/*所有分片的媒体时长*/
+	var duration float64
+	for _, seg := range d.result.M3u8.Segments {
+		duration += float64(seg.Duration)
+	}
+	d.emit(Event{
+		Type:     EventTaskFinished,
+		Segment:  -1,
+		Bytes:    atomic.LoadInt64(&d.bytes),
+		Err:      err,
+		Done:     int(atomic.LoadInt32(&d.finish)),
+		Total:    d.segLen,
+		Output:   output,
+		Elapsed:  time.Since(start),
+		Duration: time.Duration(duration * float64(time.Second)),
+	})
+}
+
+// SetFormat sets the output format, FormatTS by default
+func (d *Downloader) SetFormat(format Format) error {
+	switch format {
+	case FormatTS, FormatHLS, FormatMP4:
+		d.format = format
+		return nil
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// SetRateLimit limits the download rate of all segments to bytesPerSecond, 0 for
+// unlimited. It may be called while downloading, e.g. to throttle a long recording.
+// The limit is shared with the playlist and key requests when the client of
+// parse.Options has a Limiter.
+func (d *Downloader) SetRateLimit(bytesPerSecond int64) {
+	d.client.Limiter.SetRate(bytesPerSecond)
+}
+
+// SetKeepEncrypted keeps encrypted segments as they are and stores their keys
+// next to the local playlist, only supported by FormatHLS
+func (d *Downloader) SetKeepEncrypted(keep bool) {
+	d.keepEncrypted = keep
+}
+
+/*执行队列中的所有job，直至全部完成、放弃或ctx取消*/
+func (d *Downloader) run(ctx context.Context, concurrency int, continueFlag bool, maxTries int) error {
 	var wg sync.WaitGroup
-	// struct{} zero size
-	limitChan := make(chan struct{}, concurrency)
-	for {
+	d.workers.init(concurrency)
+	for ctx.Err() == nil {
+		/*占用并发名额，已满时等待分片完成*/
+		if !d.workers.acquire() {
+			d.wait(ctx, -1)
+			continue
+		}
 		/*取等执行job*/
-		slice, end, err := d.next()
-		if err != nil {
-			if end {
-				break
-			}
+		slice, wait, end := d.next()
+		if end {
+			d.workers.release()
+			break
+		}
+		if slice == nil {
+			/*等待重试时间到达、分片重新入队或完成*/
+			d.workers.release()
+			d.wait(ctx, wait)
 			continue
 		}
 		wg.Add(1)
 		go func(idx int, tries int) {
 			defer wg.Done()
+			defer d.notify()
+			defer d.workers.release()
+			started := time.Now()
 			/*针对idx号job执行download*/
-			if err := d.proxyDownload(idx, continueFlag); err != nil {
+			if err := d.proxyDownload(ctx, idx, tries, continueFlag); err != nil {
+				if ctx.Err() != nil {
+					/*被取消的分片不计失败，下次续传时重新下载*/
+					return
+				}
+				if retryable(err) {
+					/*可能是对端过载，减少并发*/
+					d.workers.failed(started)
+				}
 				/*download时出错，将job扔回*/
 				tries = tries + 1
-				if maxTries <= 0 || tries < maxTries {
-					// Back into the queue, retry request
-					fmt.Printf("[failed(%d/%d)] %s\n", tries, maxTries, err.Error())
-					if err := d.back(idx, tries); err != nil {
-						fmt.Printf(err.Error())
+				event := Event{Segment: idx, URL: d.tsURL(idx), Tries: tries, Err: err, Total: d.segLen, Workers: d.workers.level()}
+				if retryable(err) && (maxTries <= 0 || tries < maxTries) {
+					// Back into the queue, retry request after a delay
+					delay := d.retryDelay(tries, err)
+					tool.Log().Warn("segment failed, retrying", "segment", idx, "tries", tries, "max_tries", maxTries, "delay", delay, "error", err)
+					if err := d.back(idx, tries, delay); err != nil {
+						tool.Log().Error("requeue segment failed", "segment", idx, "error", err)
 					}
+					event.Type = EventSegmentRetried
+					event.Done = int(atomic.LoadInt32(&d.finish))
+					event.Delay = delay
 				} else {
-					atomic.AddInt32(&d.finish, 1)
-					fmt.Printf("[failed & giveup] %s\n", err.Error())
+					event.Type = EventSegmentFailed
+					event.Done = int(atomic.AddInt32(&d.finish, 1))
+					d.setFailed(err)
+					tool.Log().Error("segment failed, giving up", "segment", idx, "tries", tries, "error", err)
 				}
+				d.emit(event)
 			}
-			<-limitChan
 		}(slice.segId, slice.tries)
-		limitChan <- struct{}{}
 	}
+	/*等待进行中的分片结束，取消时保存完成状态*/
 	wg.Wait()
-	/*任务完成，执行merge*/
-	if err := d.merge(); err != nil {
+	if err := ctx.Err(); err != nil {
+		if e := d.finishState.flush(filepath.Join(d.tsFolder, finishStateFileName)); e != nil {
+			return fmt.Errorf("save finish state: %s", e.Error())
+		}
 		return err
 	}
 	return nil
@@ -150,30 +320,37 @@ func getLastString(str string, length int) string {
     return str[startIndex:end]
 }
 
-func (d *Downloader) proxyDownload(segIndex int, continueFlag bool) error {
+func (d *Downloader) proxyDownload(ctx context.Context, segIndex int, tries int, continueFlag bool) error {
 	//tsFilename := tsFilename(segIndex)
 	tsUrl := d.tsURL(segIndex)
-	sign := "c"
 	/*检查idx是否之前已完成下载*/
 	finish := d.isFinished(segIndex)
-	if !continueFlag || !finish {
-		if err := d.download(segIndex); err != nil {
-			return err
+	resumed := continueFlag && finish
+	var n int64
+	if resumed {
+		/*沿用此前下载的文件*/
+		if info, err := os.Stat(filepath.Join(d.tsFolder, tsFilename(segIndex))); err == nil {
+			n = info.Size()
 		}
-	}
-
-	/*增加完成的job*/
-	atomic.AddInt32(&d.finish, 1)
-	if !finish {
-		err := d.updateFinishState(segIndex, tsUrl)
+	} else {
+		d.emit(Event{Type: EventSegmentStarted, Segment: segIndex, URL: tsUrl, Tries: tries,
+			Done: int(atomic.LoadInt32(&d.finish)), Total: d.segLen})
+		s, err := d.download(ctx, segIndex)
 		if err != nil {
 			return err
 		}
-		sign = "n"
+		n = s.Size
+		d.workers.succeeded(n)
+		/*记录分片身份及文件摘要，续传时据此校验*/
+		if err := d.updateFinishState(s); err != nil {
+			return err
+		}
 	}
-	//tool.DrawProgressBar("Downloading", float32(d.finish)/float32(d.segLen), progressWidth)
-	/*显示进度*/
-	fmt.Printf("\r[download(%s) %6.2f%%] %s", sign, float32(d.finish)/float32(d.segLen)*100, getLastString(tsUrl, 100))
+	/*增加完成的job，并通知进度*/
+	atomic.AddInt64(&d.bytes, n)
+	done := atomic.AddInt32(&d.finish, 1)
+	d.emit(Event{Type: EventSegmentFinished, Segment: segIndex, URL: tsUrl, Bytes: n, Tries: tries + 1,
+		Resumed: resumed, Done: int(done), Total: d.segLen, Workers: d.workers.level()})
 	return nil
 }
 
@@ -186,104 +363,198 @@ func (d *Downloader) isFinished(segIndex int) bool {
 }
 
 func (d *Downloader) isMatched(segIndex int, text string) (bool, string) {
-	return d.finishState.isMatched(segIndex, text)
+	tsUrl := d.tsURL(segIndex)
+	if strings.Contains(tsUrl, text) {
+		return true, tsUrl
+	}
+	return false, ""
 }
 
-func (d *Downloader) updateFinishState(segIndex int, tsUrl string) error {
-	return d.finishState.updateFinishState(segIndex, filepath.Join(d.tsFolder, finishStateFileName), tsUrl)
+func (d *Downloader) updateFinishState(s *SegmentState) error {
+	return d.finishState.updateFinishState(s, filepath.Join(d.tsFolder, finishStateFileName))
 }
 
-/*执行segIndex号块的下载*/
-func (d *Downloader) download(segIndex int) error {
+/*执行segIndex号块的下载，返回分片身份及写入文件的大小与摘要*/
+func (d *Downloader) download(ctx context.Context, segIndex int) (*SegmentState, error) {
 	tsFilename := tsFilename(segIndex)
-	tsUrl := d.tsURL(segIndex)
-	/*请求tsurl*/
-	b, e := tool.Get(tsUrl)
-	if e != nil {
-		return fmt.Errorf("request %s, %s", tsUrl, e.Error())
+	if segIndex < 0 || segIndex >= len(d.result.M3u8.Segments) || d.result.M3u8.Segments[segIndex] == nil {
+		return nil, fmt.Errorf("invalid segment index: %d", segIndex)
 	}
-	//noinspection GoUnhandledErrorResult
-	defer b.Close()
 	fPath := filepath.Join(d.tsFolder, tsFilename)
-	fTemp := fPath + tsTempFileSuffix
-	/*创建临时文件*/
-	f, err := os.Create(fTemp)
+	/*原始内容先写入临时文件，中断后可续传*/
+	raw := fPath + tsTempFileSuffix
+	if err := d.fetch(ctx, segIndex, raw); err != nil {
+		return nil, err
+	}
+	s := d.segmentState(segIndex)
+	s.Encrypted = d.keepsEncrypted(segIndex)
+	var err error
+	s.Size, s.SHA256, err = d.decode(segIndex, raw, fPath)
+	/*解码失败时原始内容可能有误，下次重新下载*/
+	removePart(raw)
 	if err != nil {
-		return fmt.Errorf("create file: %s, %s", tsFilename, err.Error())
+		return nil, err
 	}
+	return s, nil
+}
 
-	/*拿到tsUrl对应内容*/
-	bytes, err := ioutil.ReadAll(b)
+/*将raw解密、对齐后写入fPath，返回写入的字节数及内容的SHA-256*/
+func (d *Downloader) decode(segIndex int, raw string, fPath string) (int64, string, error) {
+	tsUrl := d.tsURL(segIndex)
+	sf := d.result.M3u8.Segments[segIndex]
+	src, err := os.Open(raw)
 	if err != nil {
-		return fmt.Errorf("read bytes: %s, %s", tsUrl, err.Error())
+		return 0, "", err
 	}
-	sf := d.result.M3u8.Segments[segIndex]
-	if sf == nil {
-		return fmt.Errorf("invalid segment index: %d", segIndex)
+	//noinspection GoUnhandledErrorResult
+	defer src.Close()
+	fTemp := fPath + tsDecodeFileSuffix
+	/*创建临时文件*/
+	f, err := os.Create(fTemp)
+	if err != nil {
+		return 0, "", fmt.Errorf("create file: %s, %s", fTemp, err.Error())
 	}
-	/*获得此seg对应的key*/
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+
+	/*按流处理: 解密 -> 同步字节对齐 -> 写文件，内存占用与分片大小无关*/
+	var r io.Reader = src
+	/*获得此seg对应的key，保持加密时内容原样写入*/
 	key, ok := d.result.Keys[sf.KeyIndex]
-	if ok && key != "" {
-		/*针对内容进行解密*/
-		bytes, err = tool.AES128Decrypt(bytes, []byte(key),
-			[]byte(d.result.M3u8.Keys[sf.KeyIndex].IV))
-		if err != nil {
-			return fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
+	encrypted := ok && key != ""
+	if !encrypted || !d.keepEncrypted {
+		var method parse.CryptMethod
+		var iv []byte
+		if encrypted {
+			keyDef := d.result.M3u8.Keys[sf.KeyIndex]
+			method = keyDef.Method
+			if iv, err = keyDef.IVBytes(sf.Sequence); err != nil {
+				return 0, "", fmt.Errorf("%w: %s, %s", ErrDecrypt, tsUrl, err.Error())
+			}
 		}
-	}
-	// https://en.wikipedia.org/wiki/MPEG_transport_stream
-	// Some TS files do not start with SyncByte 0x47, they can not be played after merging,
-	// Need to remove the bytes before the SyncByte 0x47(71).
-	syncByte := uint8(71) //0x47
-	bLen := len(bytes)
-	for j := 0; j < bLen; j++ {
-		if bytes[j] == syncByte {
-			bytes = bytes[j:]
-			break
+		if method == parse.CryptMethodAES {
+			/*针对内容进行解密*/
+			r, err = tool.NewAES128DecryptReader(r, []byte(key), iv)
+			if err != nil {
+				return 0, "", fmt.Errorf("%w: %s, %s", ErrDecrypt, tsUrl, err.Error())
+			}
+		}
+		// https://en.wikipedia.org/wiki/MPEG_transport_stream
+		// Some TS files do not start with SyncByte 0x47, they can not be played after merging,
+		// Need to remove the bytes before the SyncByte 0x47(71).
+		r = ts.NewSyncReader(r)
+		if method == parse.CryptMethodSampleAES {
+			/*SAMPLE-AES只加密TS内的音视频数据*/
+			r, err = tool.NewSampleAESDecryptReader(r, []byte(key), iv)
+			if err != nil {
+				return 0, "", fmt.Errorf("%w: %s, %s", ErrDecrypt, tsUrl, err.Error())
+			}
 		}
+		/*HTML错误页、截断的分片等不是完整的TS，按可重试的错误处理*/
+		r = newPacketValidator(r)
 	}
-	w := bufio.NewWriter(f)
-	if _, err := w.Write(bytes); err != nil {
-		return fmt.Errorf("write to %s: %s", fTemp, err.Error())
+	h := sha256.New()
+	n, err := d.write(f, io.TeeReader(r, h))
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(fTemp)
+		if encrypted && !d.keepEncrypted && errors.Is(err, ErrInvalidSegment) {
+			/*长度已在下载时校验，解密后不是TS多半是key错误，重试也不会成功*/
+			return 0, "", fmt.Errorf("%w: %s, not a transport stream after decryption, wrong key? %s", ErrDecrypt, tsUrl, err.Error())
+		}
+		return 0, "", fmt.Errorf("decode %s to %s: %w", tsUrl, fTemp, err)
 	}
 	// Release file resource to rename file
 	_ = f.Close()
-	if err = os.Rename(fTemp, fPath); err != nil {
-		return err
+	if err := os.Rename(fTemp, fPath); err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/*将r的内容经缓冲写入f，返回写入的字节数*/
+func (d *Downloader) write(f *os.File, r io.Reader) (int64, error) {
+	w := bufio.NewWriter(f)
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, err
 	}
+	return n, w.Flush()
+}
 
-	return nil
+/*统计读取的字节数*/
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
 }
 
-func (d *Downloader) next() (slice *FileSlice, end bool, err error) {
+/*取出可执行的job；没有时返回需等待的时长，-1表示等待进行中的分片*/
+func (d *Downloader) next() (slice *FileSlice, wait time.Duration, end bool) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	if len(d.queue) == 0 {
-		err = fmt.Errorf("queue empty")
-		if d.finish == int32(d.segLen) {
+		if atomic.LoadInt32(&d.finish) == int32(d.segLen) {
 			/*队列为空，且均完成*/
 			end = true
 			return
 		}
 		// Some segment indexes are still running.
-		end = false
+		wait = -1
 		return
 	}
 
-	/*取队首的任务*/
-	slice = d.queue[0]
-	d.queue = d.queue[1:]
+	/*取最先入队且已到重试时间的任务*/
+	now := time.Now()
+	for i, s := range d.queue {
+		if !s.ready.After(now) {
+			slice = s
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			return
+		}
+		if w := s.ready.Sub(now); wait == 0 || w < wait {
+			wait = w
+		}
+	}
 	return
 }
 
-/*将segIndex号job回弹，稍后重试*/
-func (d *Downloader) back(segIndex int, tries int) error {
+/*等待wait时长(小于0时不限)、ctx取消或notify*/
+func (d *Downloader) wait(ctx context.Context, wait time.Duration) {
+	var timeout <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+	case <-d.wake:
+	case <-timeout:
+	}
+}
+
+/*唤醒等待中的调度*/
+func (d *Downloader) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*将segIndex号job回弹，delay之后重试*/
+func (d *Downloader) back(segIndex int, tries int, delay time.Duration) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	if sf := d.result.M3u8.Segments[segIndex]; sf == nil {
 		return fmt.Errorf("invalid segment index: %d", segIndex)
 	}
-	d.queue = append(d.queue, &FileSlice{segId: segIndex, tries: tries})
+	d.queue = append(d.queue, &FileSlice{segId: segIndex, tries: tries, ready: time.Now().Add(delay)})
 	return nil
 }
 
@@ -291,17 +562,9 @@ func (d *Downloader) back(segIndex int, tries int) error {
 func (d *Downloader) merge() error {
 	//return fmt.Errorf("skip.... merge")
 	// In fact, the number of downloaded segments should be equal to number of m3u8 segments
-	missingCount := 0
-	for idx := 0; idx < d.segLen; idx++ {
-		tsFilename := tsFilename(idx)
-		f := filepath.Join(d.tsFolder, tsFilename)
-		if _, err := os.Stat(f); err != nil {
-			missingCount++
-		}
-	}
-
-	if missingCount > 0 {
-		fmt.Printf("[warning] %d files missing\n", missingCount)
+	missing, err := d.checkGaps()
+	if err != nil {
+		return err
 	}
 
 	// Create a TS file for merging, all segment files will be written to this file.
@@ -323,28 +586,44 @@ func (d *Downloader) merge() error {
 			skipCount++
 			continue
 		}
-		tsFilename := tsFilename(segIndex)
-		bytes, err := ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename))
-		_, err = writer.Write(bytes)
-		if err != nil {
+		if missing[segIndex] {
 			continue
 		}
+		/*读取失败时不生成残缺的输出，保留ts目录*/
+		if err := d.appendSegment(writer, segIndex); err != nil {
+			_ = mFile.Close()
+			_ = os.Remove(mFilePath)
+			return err
+		}
 		mergedCount++
-		tool.DrawProgressBar("merge",
-			float32(mergedCount)/float32(d.segLen), progressWidth)
+		d.emit(Event{Type: EventMergeProgress, Segment: -1, Done: mergedCount, Total: d.segLen})
 	}
 
-	_ = writer.Flush()
-	//if (mergedCount + skipCount) != d.segLen {
-	fmt.Printf("[warning] files merge failed(miss %d, skip %d) ", d.segLen-(mergedCount+skipCount), skipCount)
-	//} else {
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("write to %s: %s", mFilePath, err.Error())
+	}
 
 	//return fmt.Errorf("skip.... merge")
+	tool.Log().Info("output written", "path", mFilePath, "segments", mergedCount, "skip", skipCount)
+	if len(missing) > 0 {
+		return d.incomplete(len(missing), mFilePath)
+	}
 	// Remove `ts` folder
 	_ = os.RemoveAll(d.tsFolder)
-	fmt.Printf("\n[output] %s\n", mFilePath)
-	//}
+	return nil
+}
 
+/*将segIndex号分片文件追加到w*/
+func (d *Downloader) appendSegment(w io.Writer, segIndex int) error {
+	f, err := os.Open(filepath.Join(d.tsFolder, tsFilename(segIndex)))
+	if err != nil {
+		return fmt.Errorf("read segment %d: %s", segIndex, err.Error())
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("merge segment %d: %s", segIndex, err.Error())
+	}
 	return nil
 }
 
@@ -353,8 +632,19 @@ func (d *Downloader) tsURL(segIndex int) string {
 	return tool.ResolveURL(d.result.URL, seg.URI)
 }
 
+/*输出文件路径*/
+func (d *Downloader) outputPath() string {
+	switch d.format {
+	case FormatHLS:
+		return filepath.Join(d.folder, hlsPlaylistFilename)
+	case FormatMP4:
+		return filepath.Join(d.folder, strings.TrimSuffix(d.fileName, tsExt)+mp4Ext)
+	}
+	return filepath.Join(d.folder, d.fileName)
+}
+
 func (d *Downloader) IsExist() bool {
-	mFilePath := filepath.Join(d.folder, d.fileName)
+	mFilePath := d.outputPath()
 	exist, err := path_exists(mFilePath)
 	if err != nil {
 		return false
@@ -363,7 +653,7 @@ func (d *Downloader) IsExist() bool {
 	return exist
 }
 func (d *Downloader) GetFileName() string {
-	return d.fileName
+	return filepath.Base(d.outputPath())
 }
 
 func tsFilename(ts int) string {
@@ -0,0 +1,475 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+func TestDownloadByteRange(t *testing.T) {
+	var single []byte
+	for i := 0; i < 6; i++ {
+		single = append(single, tsPacket(byte(i))...)
+	}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10.0,\n#EXT-X-BYTERANGE:376@188\nall.ts\n" +
+		"#EXTINF:10.0,\n#EXT-X-BYTERANGE:564\nall.ts\n#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			fmt.Fprint(w, playlist)
+			return
+		}
+		http.ServeContent(w, r, "all.ts", time.Time{}, bytes.NewReader(single))
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, expected := range [][]byte{single[188:564], single[564:]} {
+		if _, err := d.download(context.Background(), idx); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename(idx)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("segment %d: expected %d bytes, result: %d bytes", idx, len(expected), len(got))
+		}
+	}
+}
+
+func TestStartContextCancel(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\n0.ts\n#EXTINF:10,\nslow.ts\n#EXTINF:10,\n2.ts\n#EXT-X-ENDLIST\n"
+	var slow int32 = 1
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/slow.ts":
+			if atomic.LoadInt32(&slow) == 1 {
+				/*阻塞至客户端取消请求*/
+				started <- struct{}{}
+				<-r.Context().Done()
+				return
+			}
+			w.Write(tsPacket(1))
+		default:
+			w.Write(tsPacket(0))
+		}
+	}))
+	defer srv.Close()
+
+	folder := t.TempDir()
+	d, err := NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if err := d.StartContext(ctx, 1, true, 0); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, result: %v", err)
+	}
+	if d.IsExist() {
+		t.Fatal("expected no output after cancellation")
+	}
+
+	/*续传时只下载未完成的分片*/
+	atomic.StoreInt32(&slow, 0)
+	d, err = NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.isFinished(0) || d.isFinished(1) {
+		t.Fatal("expected segment 0 finished and segment 1 pending")
+	}
+	if err := d.Start(1, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !d.IsExist() {
+		t.Fatal("expected output after resume")
+	}
+}
+
+func TestDownloadDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	plain := [][]byte{tsPacket(1), tsPacket(2)}
+	ivs := [][]byte{
+		[]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f"),
+		/*未指定IV时使用media sequence*/
+		append(make([]byte, 15), 4),
+	}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:3\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"k.key\",IV=0x000102030405060708090a0b0c0d0e0f\n#EXTINF:10,\n0.ts\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"k.key\"\n#EXTINF:10,\n1.ts\n#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/k.key":
+			w.Write(key)
+		default:
+			idx := int(r.URL.Path[1] - '0')
+			b, err := tool.AES128Encrypt(append([]byte(nil), plain[idx]...), key, ivs[idx])
+			if err != nil {
+				t.Error(err)
+			}
+			w.Write(b)
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := range plain {
+		if _, err := d.download(context.Background(), idx); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename(idx)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain[idx]) {
+			t.Fatalf("segment %d not decrypted", idx)
+		}
+	}
+
+	/*key错误时解密结果不是TS，不再重试*/
+	d.result.Keys[d.result.M3u8.Segments[0].KeyIndex] = "fedcba9876543210"
+	_, err = d.download(context.Background(), 0)
+	if !errors.Is(err, ErrDecrypt) || retryable(err) {
+		t.Fatalf("expected a decrypt error not retried, result: %v", err)
+	}
+}
+
+func TestMergeGaps(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\n0.ts\n#EXTINF:4.5,\nmissing.ts\n#EXTINF:10,\n2.ts\n#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/missing.ts":
+			http.NotFound(w, r)
+		default:
+			w.Write(tsPacket(0))
+		}
+	}))
+	defer srv.Close()
+
+	/*默认拒绝生成有缺失的输出，保留ts目录*/
+	folder := t.TempDir()
+	d, err := NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := lastTaskFinished(d)
+	if err := d.Start(2, true, 1); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected incomplete download, result: %v", err)
+	}
+	if d.IsExist() {
+		t.Fatal("output written although a segment is missing")
+	}
+	if finished.Output != "" {
+		t.Fatalf("expected no output in task_finished, result: %q", finished.Output)
+	}
+	if _, err := os.Stat(filepath.Join(d.tsFolder, tsFilename(0))); err != nil {
+		t.Fatalf("expected segments to be kept: %v", err)
+	}
+
+	/*允许缺失时写出输出及缺失报告*/
+	d, err = NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetAllowGaps(true)
+	finished = lastTaskFinished(d)
+	if err := d.Start(2, true, 1); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected incomplete download, result: %v", err)
+	}
+	if finished.Output != d.outputPath() {
+		t.Fatalf("expected output %s in task_finished, result: %q", d.outputPath(), finished.Output)
+	}
+	got, err := ioutil.ReadFile(d.outputPath())
+	if err != nil || !bytes.Equal(got, append(tsPacket(0), tsPacket(0)...)) {
+		t.Fatalf("unexpected output of %d bytes, %v", len(got), err)
+	}
+	report, err := ioutil.ReadFile(d.outputPath() + gapReportSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "1\t00:00:10.000\t00:00:14.500\t" + srv.URL + "/missing.ts\n"
+	if !strings.HasSuffix(string(report), expected) {
+		t.Fatalf("expected gap report ending with %q, result:\n%s", expected, report)
+	}
+}
+
+/*记录d的task_finished事件*/
+func lastTaskFinished(d *Downloader) *Event {
+	finished := &Event{}
+	d.Subscribe(ObserverFunc(func(e Event) {
+		if e.Type == EventTaskFinished {
+			*finished = e
+		}
+	}))
+	return finished
+}
+
+func TestDownloadResume(t *testing.T) {
+	var content []byte
+	for i := 0; i < 10; i++ {
+		content = append(content, tsPacket(byte(i))...)
+	}
+	etag := `"v1"`
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".m3u8") {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nall.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "all.ts", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := filepath.Join(d.tsFolder, tsFilename(0)) + tsTempFileSuffix
+	/*模拟中断: 临时文件中已有data*/
+	partial := func(data []byte) {
+		if err := ioutil.WriteFile(raw, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		meta := &partMeta{URL: d.tsURL(0), ETag: `"v1"`}
+		if err := meta.save(raw + partMetaSuffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	partial(content[:3*188])
+	if _, err := d.download(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if ranges[0] != `bytes=564- "v1"` {
+		t.Fatalf("expected resume from byte 564 with If-Range, result: %q", ranges[0])
+	}
+	got, err := ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename(0)))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected segment of %d bytes, %v", len(got), err)
+	}
+	if _, err := os.Stat(raw); !os.IsNotExist(err) {
+		t.Fatal("expected temporary file to be removed")
+	}
+
+	/*内容已变化时If-Range失败，对端返回完整内容*/
+	etag = `"v2"`
+	partial(content[:3*188])
+	if _, err := d.download(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename(0)))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected segment of %d bytes after refetch, %v", len(got), err)
+	}
+
+	/*中断于接收完全部内容之后，对端以416声明相同的长度*/
+	etag = `"v1"`
+	ranges = nil
+	partial(content)
+	if _, err := d.download(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 {
+		t.Fatalf("expected a single request, result: %q", ranges)
+	}
+	got, err = ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename(0)))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected segment of %d bytes after 416, %v", len(got), err)
+	}
+
+	/*临时文件比对端内容长，416后从头下载*/
+	ranges = nil
+	partial(append(append([]byte(nil), content...), tsPacket(10)...))
+	if _, err := d.download(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[1] != " " {
+		t.Fatalf("expected a full request after 416, result: %q", ranges)
+	}
+	got, err = ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename(0)))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected segment of %d bytes after refetch on 416, %v", len(got), err)
+	}
+}
+
+func TestResumeReorderedPlaylist(t *testing.T) {
+	content := map[string][]byte{"/a.ts": tsPacket(1), "/b.ts": tsPacket(2), "/c.ts": tsPacket(3)}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\na.ts?sig=1\n#EXTINF:10,\nb.ts?sig=1\n#EXTINF:10,\nc.ts?sig=1\n#EXT-X-ENDLIST\n"
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, playlist)
+			return
+		}
+		fetched = append(fetched, r.URL.Path)
+		w.Write(content[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	folder := t.TempDir()
+	d, err := NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	/*完成a、b两个分片后中断*/
+	for idx := 0; idx < 2; idx++ {
+		s, err := d.download(context.Background(), idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.updateFinishState(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	/*对端重排分片并更换签名，a、b移到新编号下，只下载c*/
+	playlist = "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\nc.ts?sig=2\n#EXTINF:10,\na.ts?sig=2\n#EXTINF:10,\nb.ts?sig=2\n#EXT-X-ENDLIST\n"
+	d, err = NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.isFinished(0) || !d.isFinished(1) || !d.isFinished(2) {
+		t.Fatal("expected segments 1 and 2 matched by URI, segment 0 pending")
+	}
+	if _, err := os.Stat(filepath.Join(d.tsFolder, tsFilename(0))); !os.IsNotExist(err) {
+		t.Fatal("expected stale file of segment 0 to be removed")
+	}
+	fetched = nil
+	if err := d.Start(1, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 || fetched[0] != "/c.ts" {
+		t.Fatalf("expected only c.ts downloaded, result: %v", fetched)
+	}
+	got, err := ioutil.ReadFile(d.outputPath())
+	expected := append(append(tsPacket(3), tsPacket(1)...), tsPacket(2)...)
+	if err != nil || !bytes.Equal(got, expected) {
+		t.Fatalf("unexpected output of %d bytes, %v", len(got), err)
+	}
+}
+
+func TestFinishStateLegacy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\na.ts\n#EXTINF:10,\nb.ts\n#EXT-X-ENDLIST\n")
+			return
+		}
+		w.Write(tsPacket(0))
+	}))
+	defer srv.Close()
+
+	/*版本1按编号记录，1号记录的url与当前playlist不符*/
+	tsFolder := filepath.Join(t.TempDir(), tsFolderName)
+	if err := os.MkdirAll(tsFolder, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	legacy := fmt.Sprintf(`{"-1":{"state":false,"index":-1,"url":"%[1]s/index.m3u8"},`+
+		`"0":{"state":true,"index":0,"url":"%[1]s/a.ts"},"1":{"state":true,"index":1,"url":"%[1]s/old.ts"}}`, srv.URL)
+	if err := ioutil.WriteFile(filepath.Join(tsFolder, finishStateFileName), []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if err := ioutil.WriteFile(filepath.Join(tsFolder, tsFilename(idx)), tsPacket(0), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := NewTask(filepath.Dir(tsFolder), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.isFinished(0) || d.isFinished(1) {
+		t.Fatal("expected segment 0 migrated and segment 1 pending")
+	}
+	s := d.finishState.state[0]
+	if s.Path != "/a.ts" || s.Size != 188 || s.SHA256 == "" {
+		t.Fatalf("unexpected migrated state: %+v", s)
+	}
+}
+
+func TestDownloadIntegrity(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\npage.ts\n#EXTINF:10,\nshort.ts\n#EXTINF:10,\n#EXT-X-BYTERANGE:376@188\nall.ts\n" +
+		"#EXTINF:10,\nflaky.ts\n#EXT-X-ENDLIST\n"
+	var flaky int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/page.ts":
+			fmt.Fprint(w, "<html><body>rate limited</body></html>")
+		case "/short.ts":
+			w.Write(append(tsPacket(0), tsPacket(1)[:100]...))
+		case "/all.ts":
+			/*资源比byte range短*/
+			http.ServeContent(w, r, "all.ts", time.Time{}, bytes.NewReader(bytes.Repeat(tsPacket(0), 2)))
+		case "/flaky.ts":
+			if atomic.AddInt32(&flaky, 1) == 1 {
+				w.Write(bytes.Repeat([]byte{0xff}, 188))
+				return
+			}
+			w.Write(tsPacket(3))
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if _, err := d.download(context.Background(), idx); !errors.Is(err, ErrInvalidSegment) {
+			t.Fatalf("segment %d: expected invalid segment, result: %v", idx, err)
+		}
+		if _, err := os.Stat(filepath.Join(d.tsFolder, tsFilename(idx))); !os.IsNotExist(err) {
+			t.Fatalf("segment %d: invalid segment kept", idx)
+		}
+	}
+	if !retryable(fmt.Errorf("wrapped: %w", ErrInvalidSegment)) {
+		t.Fatal("expected invalid segments to be retried")
+	}
+
+	/*校验失败的分片不留下原始内容，重新下载后成功*/
+	if _, err := d.download(context.Background(), 3); !errors.Is(err, ErrInvalidSegment) {
+		t.Fatalf("expected invalid segment, result: %v", err)
+	}
+	if _, err := d.download(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDecrypt is wrapped by errors of decrypting a segment
+	ErrDecrypt = errors.New("decrypt")
+	// ErrIncomplete is matched by errors of tasks whose output misses segments
+	ErrIncomplete = errors.New("incomplete download")
+	// ErrInvalidSegment is wrapped by errors of segments failing the integrity
+	// checks (not a transport stream, truncated, length mismatch), they are retried.
+	// An encrypted segment failing them after decryption reports ErrDecrypt instead.
+	ErrInvalidSegment = errors.New("invalid segment")
+)
+
+// IncompleteError reports segments missing from the output,
+// errors.Is(err, ErrIncomplete) is true for it
+type IncompleteError struct {
+	Missing int
+	Total   int
+	// Output is the file written without the missing segments (SetAllowGaps),
+	// empty when the output was refused
+	Output string
+	// Err is the last error of the segments given up, nil if unknown
+	Err error
+}
+
+func (e *IncompleteError) Error() string {
+	msg := fmt.Sprintf("%s: %d of %d segments missing", ErrIncomplete.Error(), e.Missing, e.Total)
+	if e.Err != nil {
+		msg += ", last error: " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is matches ErrIncomplete
+func (e *IncompleteError) Is(target error) bool {
+	return target == ErrIncomplete
+}
+
+// Unwrap returns the last segment error
+func (e *IncompleteError) Unwrap() error {
+	return e.Err
+}
+
+/*记录放弃的分片的错误*/
+func (d *Downloader) setFailed(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.failErr = err
+}
+
+/*输出缺少missing个分片时返回IncompleteError，output为已写出的输出，拒绝输出时为空*/
+func (d *Downloader) incomplete(missing int, output string) error {
+	if missing <= 0 {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return &IncompleteError{Missing: missing, Total: d.segLen, Output: output, Err: d.failErr}
+}
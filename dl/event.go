@@ -0,0 +1,189 @@
+package dl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+// EventType identifies what an Event reports
+type EventType string
+
+const (
+	EventSegmentStarted  EventType = "segment_started"  // a segment request is sent
+	EventSegmentFinished EventType = "segment_finished" // a segment is stored, Bytes is its size
+	EventSegmentRetried  EventType = "segment_retried"  // a failed segment is queued again, Err is the failure
+	EventSegmentFailed   EventType = "segment_failed"   // a segment failed maxTries times and is given up
+	EventMergeProgress   EventType = "merge_progress"   // Done of Total segments are merged into the output
+	EventTaskFinished    EventType = "task_finished"    // the task ended, Err is nil on success
+	EventWarning         EventType = "warning"          // something went wrong without stopping the task, see Message
+)
+
+// Event reports the progress of a Downloader
+type Event struct {
+	Type EventType
+	// Segment is the segment index, -1 for merge, task and multi segment warning events
+	Segment int
+	URL     string
+	// Bytes of the segment, or of all segments for EventTaskFinished
+	Bytes int64
+	// Tries of the segment so far
+	Tries int
+	// Resumed is set when the segment was finished by a previous run
+	Resumed bool
+	Err     error
+	// Done and Total count the finished (or merged) segments
+	Done  int
+	Total int
+	// Output is the output path of EventTaskFinished, empty when no output was written
+	Output  string
+	Elapsed time.Duration
+	// Delay before the segment of EventSegmentRetried is requested again
+	Delay time.Duration
+	// Workers is the current number of workers with adaptive concurrency, 0 otherwise
+	Workers int
+	// Duration is the media duration of the segments of EventTaskFinished
+	Duration time.Duration
+	// Message and Missing describe an EventWarning, e.g. "segment files missing"
+	Message string
+	Missing int
+}
+
+// Observer receives the events of a Downloader. OnEvent is called from the
+// download goroutines, it must be safe for concurrent use and return quickly.
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// ObserverFunc adapts a function to an Observer
+type ObserverFunc func(e Event)
+
+// OnEvent implements Observer
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// Subscribe adds an observer, it must be called before Start or Record
+func (d *Downloader) Subscribe(o Observer) {
+	d.observers = append(d.observers, o)
+}
+
+func (d *Downloader) emit(e Event) {
+	for _, o := range d.observers {
+		o.OnEvent(e)
+	}
+}
+
+/*通知缺失的分片文件，segment为-1时表示多个分片*/
+func (d *Downloader) emitMissing(msg string, segment int, missing int) {
+	d.emit(Event{Type: EventWarning, Segment: segment, Message: msg, Missing: missing, Total: d.segLen})
+}
+
+// ProgressBar prints the download and merge progress on a single terminal line
+type ProgressBar struct {
+	lock sync.Mutex
+}
+
+// NewProgressBar returns the terminal progress observer
+func NewProgressBar() *ProgressBar {
+	return &ProgressBar{}
+}
+
+// OnEvent implements Observer
+func (p *ProgressBar) OnEvent(e Event) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch e.Type {
+	case EventSegmentFinished:
+		/*c表示此前已完成，n表示本次下载*/
+		sign := "n"
+		if e.Resumed {
+			sign = "c"
+		}
+		/*自适应并发时显示当前并发数*/
+		workers := ""
+		if e.Workers > 0 {
+			workers = fmt.Sprintf(" x%d", e.Workers)
+		}
+		fmt.Printf("\r[download(%s) %6.2f%%%s] %s", sign, float32(e.Done)/float32(e.Total)*100, workers, getLastString(e.URL, 100))
+	case EventMergeProgress:
+		tool.DrawProgressBar("merge", float32(e.Done)/float32(e.Total), progressWidth)
+	case EventTaskFinished:
+		/*结束进度行*/
+		fmt.Println()
+	}
+}
+
+// JSONReporter writes each event as a JSON object on its own line (NDJSON)
+type JSONReporter struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONReporter returns an observer writing events to w
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{enc: json.NewEncoder(w)}
+}
+
+type jsonEvent struct {
+	Time     string  `json:"time"`
+	Event    string  `json:"event"`
+	Segment  *int    `json:"segment,omitempty"`
+	URL      string  `json:"url,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+	Tries    int     `json:"tries,omitempty"`
+	Resumed  bool    `json:"resumed,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Message  string  `json:"message,omitempty"`
+	Missing  int     `json:"missing,omitempty"`
+	Done     int     `json:"done"`
+	Total    int     `json:"total"`
+	Output   string  `json:"output,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Elapsed  float64 `json:"elapsed,omitempty"`
+	Delay    float64 `json:"delay,omitempty"`
+	Workers  int     `json:"workers,omitempty"`
+}
+
+// OnEvent implements Observer
+func (r *JSONReporter) OnEvent(e Event) {
+	v := jsonEvent{
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Event:    string(e.Type),
+		URL:      e.URL,
+		Bytes:    e.Bytes,
+		Tries:    e.Tries,
+		Resumed:  e.Resumed,
+		Message:  e.Message,
+		Missing:  e.Missing,
+		Done:     e.Done,
+		Total:    e.Total,
+		Output:   e.Output,
+		Duration: e.Duration.Seconds(),
+		Elapsed:  e.Elapsed.Seconds(),
+		Delay:    e.Delay.Seconds(),
+		Workers:  e.Workers,
+	}
+	if e.Segment >= 0 {
+		segment := e.Segment
+		v.Segment = &segment
+	}
+	if e.Err != nil {
+		v.Error = e.Err.Error()
+	}
+	if e.Output != "" {
+		/*输出文件的大小*/
+		if info, err := os.Stat(e.Output); err == nil {
+			v.Size = info.Size()
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_ = r.enc.Encode(v)
+}
@@ -0,0 +1,110 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\n0.ts\n#EXTINF:10,\nflaky.ts\n#EXT-X-ENDLIST\n"
+	flaky := true
+	var lock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/flaky.ts":
+			/*第一次请求失败*/
+			if flaky {
+				flaky = false
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write(tsPacket(1))
+		default:
+			w.Write(append(tsPacket(0), tsPacket(0)...))
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetRetryBackoff(time.Millisecond, 10*time.Millisecond)
+	var events []Event
+	d.Subscribe(ObserverFunc(func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, e)
+	}))
+	if err := d.Start(1, false, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	count := map[EventType]int{}
+	for _, e := range events {
+		count[e.Type]++
+		if e.Type == EventSegmentFinished && e.Bytes != int64(len(tsPacket(0))*(2-e.Segment)) {
+			t.Fatalf("segment %d: unexpected bytes %d", e.Segment, e.Bytes)
+		}
+	}
+	expected := map[EventType]int{
+		EventSegmentStarted:  3,
+		EventSegmentRetried:  1,
+		EventSegmentFinished: 2,
+		EventMergeProgress:   2,
+		EventTaskFinished:    1,
+	}
+	for typ, n := range expected {
+		if count[typ] != n {
+			t.Fatalf("expected %d %s events, result: %d", n, typ, count[typ])
+		}
+	}
+	last := events[len(events)-1]
+	if last.Type != EventTaskFinished || last.Err != nil || last.Done != 2 || last.Total != 2 ||
+		last.Bytes != int64(3*len(tsPacket(0))) || last.Output != d.outputPath() {
+		t.Fatalf("unexpected task event %+v", last)
+	}
+}
+
+func TestJSONReporter(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewJSONReporter(&buf)
+	r.OnEvent(Event{Type: EventSegmentFinished, Segment: 0, Bytes: 188, Done: 1, Total: 2})
+	r.OnEvent(Event{Type: EventWarning, Segment: -1, Message: "segment files missing", Missing: 1, Total: 2})
+	r.OnEvent(Event{Type: EventTaskFinished, Segment: -1, Done: 2, Total: 2, Elapsed: 1500 * time.Millisecond,
+		Err: fmt.Errorf("failed")})
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var v map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, v)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, result: %d", len(lines))
+	}
+	if lines[0]["event"] != "segment_finished" || lines[0]["segment"] != 0.0 || lines[0]["bytes"] != 188.0 {
+		t.Fatalf("unexpected segment event %v", lines[0])
+	}
+	if _, ok := lines[1]["segment"]; ok || lines[1]["missing"] != 1.0 || lines[1]["message"] != "segment files missing" {
+		t.Fatalf("unexpected warning event %v", lines[1])
+	}
+	if lines[2]["error"] != "failed" || lines[2]["elapsed"] != 1.5 {
+		t.Fatalf("unexpected task event %v", lines[2])
+	}
+}
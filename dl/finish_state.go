@@ -1,24 +1,73 @@
 package dl
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
-	"sync"
-	//"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/anlaneg/m3u8/tool"
 )
 
+/*.finished的格式版本，版本1为按编号记录的map[int]State*/
+const finishStateVersion = 2
+
+/*调整分片编号时的中间文件后缀*/
+const tsMoveFileSuffix = "_move"
+
+// State is a segment of the version 1 .finished format, only read to migrate it
 type State struct {
 	Finish   bool   `json:"state"`
 	SegIndex int    `json:"index"`
 	TsUrl    string `json:"url"`
 }
 
+// SegmentState records a downloaded segment: its identity in the playlist
+// (URI path and byte range) and the file written for it (size and SHA-256)
+type SegmentState struct {
+	// Index of the segment, its file is ts/<Index>.ts
+	Index int    `json:"index"`
+	URL   string `json:"url"`
+	// Path of the URI without query, stable when signed URLs rotate
+	Path     string  `json:"path"`
+	Offset   uint64  `json:"offset,omitempty"`
+	Length   uint64  `json:"length,omitempty"`
+	Duration float32 `json:"duration"`
+	Size     int64   `json:"size"`
+	SHA256   string  `json:"sha256,omitempty"`
+	// Encrypted is set when the file was kept encrypted (SetKeepEncrypted)
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+/*分片在playlist中的身份，与编号及query无关*/
+func (s *SegmentState) id() string {
+	return fmt.Sprintf("%s@%d+%d", s.Path, s.Offset, s.Length)
+}
+
 type FinishState struct {
-	lock sync.Mutex
-	//state map[int]bool
-	//exState map[int]State
-	state map[int]State
+	lock        sync.Mutex
+	url         string
+	fingerprint string
+	count       int
+	state       map[int]*SegmentState
+}
+
+/*.finished文件内容*/
+type finishStateFile struct {
+	Version     int    `json:"version"`
+	URL         string `json:"url"`
+	Fingerprint string `json:"fingerprint"`
+	// Count is the number of segments in the playlist
+	Count    int             `json:"count,omitempty"`
+	Segments []*SegmentState `json:"segments"`
 }
 
 func path_exists(path string) (bool, error) {
@@ -33,23 +82,38 @@ func path_exists(path string) (bool, error) {
 }
 
 func load(path string) (*FinishState, error) {
-	file, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	state := make(map[int]State)
-	//state := make(map[int]bool)
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&state)
-	if err != nil {
-		return nil, err
+	f := &FinishState{state: make(map[int]*SegmentState)}
+	var file finishStateFile
+	if err := json.Unmarshal(b, &file); err == nil && file.Version >= finishStateVersion {
+		f.url = file.URL
+		f.fingerprint = file.Fingerprint
+		f.count = file.Count
+		for _, s := range file.Segments {
+			f.state[s.Index] = s
+		}
+		return f, nil
 	}
 
-	return &FinishState{
-		state: state,
-	}, nil
+	/*版本1: 只有编号与url，大小及摘要在校验时补全*/
+	legacy := make(map[int]State)
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return nil, err
+	}
+	for idx, s := range legacy {
+		if idx < 0 {
+			f.url = s.TsUrl
+			continue
+		}
+		if s.Finish {
+			f.state[idx] = &SegmentState{Index: idx, URL: s.TsUrl, Path: uriPath(s.TsUrl), Size: -1}
+		}
+	}
+	return f, nil
 }
 
 func LoadFinishState(url string, path string) (*FinishState, error) {
@@ -59,15 +123,11 @@ func LoadFinishState(url string, path string) (*FinishState, error) {
 	}
 
 	f := &FinishState{
-		state: make(map[int]State),
+		url:   url,
+		state: make(map[int]*SegmentState),
 	}
 
 	f.lock.Lock()
-	f.state[-1] = State{
-		Finish:   false,
-		SegIndex: -1,
-		TsUrl:    url,
-	}
 	defer f.lock.Unlock()
 	if err := f.save(path); err != nil {
 		return nil, err
@@ -77,22 +137,33 @@ func LoadFinishState(url string, path string) (*FinishState, error) {
 }
 
 func (f *FinishState) save(path string) error {
-	//fmt.Println(f.state)
+	file := finishStateFile{
+		Version:     finishStateVersion,
+		URL:         f.url,
+		Fingerprint: f.fingerprint,
+		Count:       f.count,
+		Segments:    make([]*SegmentState, 0, len(f.state)),
+	}
+	for _, s := range f.state {
+		file.Segments = append(file.Segments, s)
+	}
+	sort.Slice(file.Segments, func(i, j int) bool {
+		return file.Segments[i].Index < file.Segments[j].Index
+	})
+
 	fTemp := path + tsTempFileSuffix
-	file, err := os.Create(fTemp)
+	out, err := os.Create(fTemp)
 	if err != nil {
 		return err
 	}
-	//file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
-
-	//defer file.Close()
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(f.state)
+	encoder := json.NewEncoder(out)
+	err = encoder.Encode(&file)
 	if err != nil {
+		_ = out.Close()
 		return err
 	}
 
-	_ = file.Close()
+	_ = out.Close()
 	if err = os.Rename(fTemp, path); err != nil {
 		return err
 	}
@@ -103,36 +174,220 @@ func (f *FinishState) save(path string) error {
 func (f *FinishState) isFinished(segIndex int) bool {
 	f.lock.Lock()
 	defer f.lock.Unlock()
-	meta, ok := f.state[segIndex]
-	if !ok {
-		return false
-	}
+	_, ok := f.state[segIndex]
+	return ok
+}
 
-	return meta.Finish
+func (f *FinishState) updateFinishState(s *SegmentState, path string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.state[s.Index] = s
+	/*直播录制时分片数随playlist增加*/
+	if s.Index >= f.count {
+		f.count = s.Index + 1
+	}
+	return f.save(path)
 }
 
-func (f *FinishState) isMatched(segIndex int, text string) (bool, string) {
+/*将当前完成状态写入path*/
+func (f *FinishState) flush(path string) error {
 	f.lock.Lock()
 	defer f.lock.Unlock()
-	meta, ok := f.state[segIndex]
-	if !ok {
-		return false, ""
+	return f.save(path)
+}
+
+/*segIndex号分片在当前playlist中的身份*/
+func (d *Downloader) segmentState(segIndex int) *SegmentState {
+	sf := d.result.M3u8.Segments[segIndex]
+	tsUrl := d.tsURL(segIndex)
+	return &SegmentState{
+		Index:    segIndex,
+		URL:      tsUrl,
+		Path:     uriPath(tsUrl),
+		Offset:   sf.Offset,
+		Length:   sf.Length,
+		Duration: sf.Duration,
 	}
+}
+
+/*segIndex号分片的文件是否保持加密(SetKeepEncrypted)*/
+func (d *Downloader) keepsEncrypted(segIndex int) bool {
+	sf := d.result.M3u8.Segments[segIndex]
+	key, ok := d.result.Keys[sf.KeyIndex]
+	return ok && key != "" && d.keepEncrypted
+}
 
-	if strings.Contains(meta.TsUrl, text) {
-		return true, meta.TsUrl
+/*
+此前保持加密的分片不能合并，已解密的分片不能列在EXT-X-KEY之下：
+与本次设置不一致的分片视为未完成，删除其文件后重新下载
+*/
+func (d *Downloader) dropMismatchedEncryption() error {
+	f := d.finishState
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dropped := 0
+	for idx, s := range f.state {
+		if idx >= len(d.result.M3u8.Segments) || s.Encrypted == d.keepsEncrypted(idx) {
+			continue
+		}
+		delete(f.state, idx)
+		if err := os.Remove(filepath.Join(d.tsFolder, tsFilename(idx))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dropped++
+	}
+	if dropped == 0 {
+		return nil
 	}
-	return false, ""
+	tool.Log().Info("segments saved with another keep-encrypted setting, downloading again", "redownload", dropped)
+	return f.save(filepath.Join(d.tsFolder, finishStateFileName))
 }
 
-func (f *FinishState) updateFinishState(segIndex int, path string, tsUrl string) error {
+/*
+按身份将此前完成的分片对应到当前playlist：
+playlist指纹未变时只比较文件大小，变化时(分片重排、增删)按身份查找并校验内容摘要，
+文件移到新编号下；对应不上或校验失败的分片重新下载，其残留文件被删除
+*/
+func (d *Downloader) verifyFinishState() error {
+	f := d.finishState
 	f.lock.Lock()
 	defer f.lock.Unlock()
-	f.state[segIndex] = State{
-		Finish:   true,
-		SegIndex: segIndex,
-		TsUrl:    tsUrl,
+
+	current := make([]*SegmentState, len(d.result.M3u8.Segments))
+	for i := range current {
+		current[i] = d.segmentState(i)
 	}
-	return f.save(path)
-	//return nil
+	fingerprint := playlistFingerprint(current)
+	same := fingerprint == f.fingerprint
+
+	/*此前完成的分片按身份分组，同一身份出现多次时按编号顺序对应*/
+	previous := make([]*SegmentState, 0, len(f.state))
+	for _, s := range f.state {
+		previous = append(previous, s)
+	}
+	sort.Slice(previous, func(i, j int) bool { return previous[i].Index < previous[j].Index })
+	byID := make(map[string][]*SegmentState)
+	legacy := make(map[int]*SegmentState)
+	for _, s := range previous {
+		if s.SHA256 == "" {
+			legacy[s.Index] = s
+			continue
+		}
+		byID[s.id()] = append(byID[s.id()], s)
+	}
+
+	state := make(map[int]*SegmentState)
+	moved := make(map[int]int)
+	for i, cur := range current {
+		var found *SegmentState
+		if list := byID[cur.id()]; len(list) > 0 {
+			found = list[0]
+			byID[cur.id()] = list[1:]
+		} else if s, ok := legacy[i]; ok && s.Path == cur.Path {
+			/*版本1的记录只按编号与路径对应*/
+			found = s
+		}
+		if found == nil {
+			continue
+		}
+		file := filepath.Join(d.tsFolder, tsFilename(found.Index))
+		size, sum, err := verifySegmentFile(file, found, !same || found.Index != i)
+		if err != nil {
+			tool.Log().Warn("segment changed since last run, downloading again", "segment", i, "url", cur.URL, "error", err)
+			continue
+		}
+		s := *cur
+		s.Size = size
+		s.SHA256 = sum
+		s.Encrypted = found.Encrypted
+		state[i] = &s
+		if found.Index != i {
+			moved[found.Index] = i
+		}
+	}
+	if !same && f.fingerprint != "" {
+		tool.Log().Info("playlist changed since last run, segments matched by URI", "kept", len(state), "redownload", len(current)-len(state))
+	}
+
+	/*先移开需要调整编号的文件，再删除残留文件，最后放到新编号下*/
+	for from := range moved {
+		file := filepath.Join(d.tsFolder, tsFilename(from))
+		if err := os.Rename(file, file+tsMoveFileSuffix); err != nil {
+			return err
+		}
+	}
+	for i := range current {
+		if _, ok := state[i]; !ok {
+			if err := os.Remove(filepath.Join(d.tsFolder, tsFilename(i))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for from, to := range moved {
+		file := filepath.Join(d.tsFolder, tsFilename(from))
+		if err := os.Rename(file+tsMoveFileSuffix, filepath.Join(d.tsFolder, tsFilename(to))); err != nil {
+			return err
+		}
+	}
+	for _, s := range previous {
+		if _, ok := moved[s.Index]; !ok && s.Index >= len(current) {
+			_ = os.Remove(filepath.Join(d.tsFolder, tsFilename(s.Index)))
+		}
+	}
+
+	f.state = state
+	f.fingerprint = fingerprint
+	f.count = len(current)
+	return f.save(filepath.Join(d.tsFolder, finishStateFileName))
+}
+
+/*校验分片文件的大小，check为true或记录中没有摘要时校验内容摘要，返回文件的大小与摘要*/
+func verifySegmentFile(path string, s *SegmentState, check bool) (int64, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, "", err
+	}
+	if s.Size >= 0 && info.Size() != s.Size {
+		return 0, "", fmt.Errorf("size %d, expected %d", info.Size(), s.Size)
+	}
+	if !check && s.SHA256 != "" {
+		return s.Size, s.SHA256, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if s.SHA256 != "" && sum != s.SHA256 {
+		return 0, "", fmt.Errorf("sha256 %s, expected %s", sum, s.SHA256)
+	}
+	return n, sum, nil
+}
+
+/*playlist中各分片身份与时长的摘要*/
+func playlistFingerprint(segments []*SegmentState) string {
+	h := sha256.New()
+	for _, s := range segments {
+		fmt.Fprintf(h, "%s %g\n", s.id(), s.Duration)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*去掉query的URI路径，签名url变化时保持不变*/
+func uriPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" {
+		if idx := strings.IndexAny(rawURL, "?#"); idx >= 0 {
+			return rawURL[:idx]
+		}
+		return rawURL
+	}
+	return u.Path
 }
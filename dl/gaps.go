@@ -0,0 +1,79 @@
+package dl
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+const gapReportSuffix = ".gaps.txt"
+
+// SetAllowGaps writes the output even if segments are missing, together with
+// a gap report next to it. By default the output is refused and the segment
+// folder is kept so that a later run can resume.
+func (d *Downloader) SetAllowGaps(allow bool) {
+	d.allowGaps = allow
+}
+
+/*检查缺失的分片文件，不允许缺失时返回错误，否则写出缺失报告；返回缺失分片的集合*/
+func (d *Downloader) checkGaps() (map[int]bool, error) {
+	missing := make(map[int]bool)
+	for segIndex := 0; segIndex < d.segLen; segIndex++ {
+		if match, _ := d.isMatched(segIndex, "adjump"); match {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d.tsFolder, tsFilename(segIndex))); err != nil {
+			missing[segIndex] = true
+		}
+	}
+	if len(missing) == 0 {
+		return missing, nil
+	}
+	tool.Log().Warn("segment files missing", "missing", len(missing))
+	d.emitMissing("segment files missing", -1, len(missing))
+	if !d.allowGaps {
+		/*保留ts目录，再次执行时续传缺失的分片*/
+		tool.Log().Error("output refused, segments kept for resuming", "folder", d.tsFolder)
+		return nil, d.incomplete(len(missing), "")
+	}
+	report := d.outputPath() + gapReportSuffix
+	if err := d.writeGapReport(report, missing); err != nil {
+		return nil, fmt.Errorf("write gap report %s: %s", report, err.Error())
+	}
+	tool.Log().Warn("gap report written", "path", report)
+	return missing, nil
+}
+
+/*按分片序号输出缺失分片在播放时间轴上的区间*/
+func (d *Downloader) writeGapReport(path string, missing map[int]bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# %d of %d segments missing from %s\n", len(missing), d.segLen, d.outputPath())
+	fmt.Fprintln(w, "# index\tstart\tend\turl")
+	var start float64
+	for segIndex, seg := range d.result.M3u8.Segments[:d.segLen] {
+		end := start + float64(seg.Duration)
+		if missing[segIndex] {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", segIndex, formatOffset(start), formatOffset(end), d.tsURL(segIndex))
+		}
+		start = end
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+/*秒数格式化为hh:mm:ss.mmm*/
+func formatOffset(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,119 @@
+package dl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anlaneg/m3u8/parse"
+	"github.com/anlaneg/m3u8/tool"
+)
+
+const (
+	hlsPlaylistFilename = "index.m3u8"
+	hlsKeyFolderName    = "keys"
+)
+
+/*生成可离线播放的HLS：保留ts目录中的分片，并写出指向它们的index.m3u8*/
+func (d *Downloader) writeHLS() error {
+	src := d.result.M3u8
+	local := &parse.M3u8{
+		Version:        src.Version,
+		MediaSequence:  src.MediaSequence,
+		Keys:           make(map[int]*parse.Key),
+		EndList:        true,
+		PlaylistType:   parse.PlaylistTypeVOD,
+		TargetDuration: src.TargetDuration,
+	}
+
+	missing, err := d.checkGaps()
+	if err != nil {
+		return err
+	}
+	skipCount := 0
+	/*被跳过的分片之后需标记discontinuity*/
+	gap := false
+	lastKey := ""
+	keyURIs := make(map[int]string)
+	for segIndex := 0; segIndex < d.segLen; segIndex++ {
+		seg := src.Segments[segIndex]
+		if match, _ := d.isMatched(segIndex, "adjump"); match {
+			skipCount++
+			gap = true
+			continue
+		}
+		if missing[segIndex] {
+			gap = true
+			continue
+		}
+
+		s := *seg
+		/*分片文件只包含byte range对应的子区间*/
+		s.URI = tsFolderName + "/" + tsFilename(segIndex)
+		s.Length = 0
+		s.Offset = 0
+		s.KeyIndex = 0
+		s.Discontinuity = seg.Discontinuity || (gap && len(local.Segments) > 0)
+		gap = false
+
+		if key, ok := d.result.Keys[seg.KeyIndex]; ok && key != "" && d.keepEncrypted {
+			keyURI, ok := keyURIs[seg.KeyIndex]
+			if !ok {
+				var err error
+				if keyURI, err = d.saveKey(seg.KeyIndex, key); err != nil {
+					return err
+				}
+				keyURIs[seg.KeyIndex] = keyURI
+			}
+			/*未指定IV时，播放器按media sequence推导IV；分片被跳过后序号会错位，这里写出显式的IV*/
+			iv := src.Keys[seg.KeyIndex].IV
+			if iv == "" {
+				iv = fmt.Sprintf("0x%032x", seg.Sequence)
+			}
+			if id := keyURI + iv; id != lastKey {
+				lastKey = id
+				local.Keys[len(local.Keys)+1] = &parse.Key{
+					Method: src.Keys[seg.KeyIndex].Method,
+					URI:    keyURI,
+					IV:     iv,
+				}
+			}
+			s.KeyIndex = len(local.Keys)
+		} else {
+			lastKey = ""
+		}
+		local.Segments = append(local.Segments, &s)
+	}
+
+	mFilePath := d.outputPath()
+	fTemp := mFilePath + tsTempFileSuffix
+	f, err := os.Create(fTemp)
+	if err != nil {
+		return fmt.Errorf("create playlist file failed：%s", err.Error())
+	}
+	if err := local.Encode(f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write to %s: %s", fTemp, err.Error())
+	}
+	_ = f.Close()
+	if err := os.Rename(fTemp, mFilePath); err != nil {
+		return err
+	}
+	tool.Log().Info("output written", "path", mFilePath, "segments", len(local.Segments), "skip", skipCount)
+	return d.incomplete(len(missing), mFilePath)
+}
+
+/*将keyIndex号key写入keys目录，返回其相对于index.m3u8的URI*/
+func (d *Downloader) saveKey(keyIndex int, key string) (string, error) {
+	folder := filepath.Join(d.folder, hlsKeyFolderName)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return "", fmt.Errorf("create key folder '[%s]' failed: %s", folder, err.Error())
+	}
+	name := strconv.Itoa(keyIndex) + ".key"
+	if err := ioutil.WriteFile(filepath.Join(folder, name), []byte(key), 0600); err != nil {
+		return "", fmt.Errorf("write key %s: %s", name, err.Error())
+	}
+	return hlsKeyFolderName + "/" + name, nil
+}
@@ -0,0 +1,135 @@
+package dl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+func TestWriteHLS(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:5\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"/k.key\"\n" +
+		"#EXTINF:10,\n0.ts\n#EXTINF:10,\nmissing.ts\n#EXTINF:4.5,\n2.ts\n#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/k.key":
+			fmt.Fprint(w, "0123456789abcdef")
+		case "/missing.ts":
+			http.NotFound(w, r)
+		default:
+			w.Write(tsPacket(1))
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFormat(FormatHLS); err != nil {
+		t.Fatal(err)
+	}
+	d.SetKeepEncrypted(true)
+	d.SetAllowGaps(true)
+	/*missing.ts缺失，仍生成播放列表*/
+	err = d.Start(2, true, 1)
+	var statusErr *tool.HTTPStatusError
+	if !errors.Is(err, ErrIncomplete) || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected incomplete download caused by 404, result: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(d.folder, hlsPlaylistFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `#EXTM3U
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-KEY:METHOD=AES-128,URI="keys/1.key",IV=0x00000000000000000000000000000005
+#EXTINF:10,
+ts/0.ts
+#EXT-X-KEY:METHOD=AES-128,URI="keys/1.key",IV=0x00000000000000000000000000000007
+#EXT-X-DISCONTINUITY
+#EXTINF:4.5,
+ts/2.ts
+#EXT-X-ENDLIST
+`
+	if string(got) != expected {
+		t.Fatalf("expected:\n%s\nresult:\n%s", expected, got)
+	}
+	key, err := ioutil.ReadFile(filepath.Join(d.folder, hlsKeyFolderName, "1.key"))
+	if err != nil || strings.TrimSpace(string(key)) != "0123456789abcdef" {
+		t.Fatalf("expected local key file, result: %q, %v", key, err)
+	}
+	if !d.IsExist() {
+		t.Fatal("expected index.m3u8 to exist")
+	}
+}
+
+func TestKeepEncryptedModeSwitch(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := make([]byte, 16)
+	plain := tsPacket(1)
+	encrypted, err := tool.AES128Encrypt(append([]byte(nil), plain...), key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"k.key\",IV=0x00000000000000000000000000000000\n" +
+		"#EXTINF:10,\n0.ts\n#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/k.key":
+			w.Write(key)
+		default:
+			w.Write(encrypted)
+		}
+	}))
+	defer srv.Close()
+
+	folder := t.TempDir()
+	/*依次: 解密保存、保持加密、合并为ts，每次切换都重新下载分片*/
+	runs := []struct {
+		format  Format
+		keep    bool
+		segment []byte
+	}{
+		{FormatHLS, false, plain},
+		{FormatHLS, true, encrypted},
+		{FormatTS, false, plain},
+	}
+	for i, run := range runs {
+		d, err := NewTask(folder, srv.URL+"/index.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetFormat(run.format); err != nil {
+			t.Fatal(err)
+		}
+		d.SetKeepEncrypted(run.keep)
+		if err := d.Start(1, true, 1); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		file := filepath.Join(d.tsFolder, tsFilename(0))
+		if run.format == FormatTS {
+			file = d.outputPath()
+		}
+		got, err := ioutil.ReadFile(file)
+		if err != nil || !bytes.Equal(got, run.segment) {
+			t.Fatalf("run %d: unexpected %d bytes in %s, %v", i, len(got), file, err)
+		}
+	}
+}
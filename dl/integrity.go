@@ -0,0 +1,38 @@
+package dl
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/anlaneg/m3u8/ts"
+)
+
+/*校验对齐后的分片: 每个packet以同步字节开头，总长度为packet大小的整数倍*/
+type packetValidator struct {
+	r      io.Reader
+	offset int64
+}
+
+func newPacketValidator(r io.Reader) io.Reader {
+	return &packetValidator{r: r}
+}
+
+func (v *packetValidator) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	/*检查落在本次读取范围内的packet边界*/
+	for i := (ts.PacketSize - v.offset%ts.PacketSize) % ts.PacketSize; i < int64(n); i += ts.PacketSize {
+		if p[i] != ts.SyncByte {
+			return n, fmt.Errorf("%w: no sync byte at offset %d", ErrInvalidSegment, v.offset+i)
+		}
+	}
+	v.offset += int64(n)
+	if err == io.EOF {
+		if v.offset == 0 {
+			return n, fmt.Errorf("%w: no transport stream packet", ErrInvalidSegment)
+		}
+		if v.offset%ts.PacketSize != 0 {
+			return n, fmt.Errorf("%w: %d bytes is not a multiple of %d", ErrInvalidSegment, v.offset, ts.PacketSize)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,220 @@
+package dl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anlaneg/m3u8/parse"
+	"github.com/anlaneg/m3u8/tool"
+)
+
+const (
+	// Used when the playlist does not carry #EXT-X-TARGETDURATION
+	defaultReloadInterval = 5 * time.Second
+	// Tries of a segment when recording with unlimited tries
+	liveMaxTries = 3
+)
+
+// Record keeps reloading a live or EVENT media playlist and appends every new
+// segment to the output file as soon as it is downloaded.
+// Recording stops on #EXT-X-ENDLIST or when duration (if > 0) has elapsed.
+// A maxTries <= 0 (unlimited) is capped to a few tries, so that a failing
+// segment does not hold back the playlist reloads.
+func (d *Downloader) Record(concurrency int, maxTries int, duration time.Duration) error {
+	return d.RecordContext(context.Background(), concurrency, maxTries, duration)
+}
+
+// RecordContext is Record that also stops when ctx is cancelled,
+// the segments downloaded so far are kept in the output file.
+func (d *Downloader) RecordContext(ctx context.Context, concurrency int, maxTries int, duration time.Duration) error {
+	start := time.Now()
+	err := d.record(ctx, concurrency, maxTries, duration)
+	d.emitFinished(filepath.Join(d.folder, d.fileName), start, err)
+	return err
+}
+
+func (d *Downloader) record(ctx context.Context, concurrency int, maxTries int, duration time.Duration) error {
+	mFilePath := filepath.Join(d.folder, d.fileName)
+	mFile, err := os.Create(mFilePath)
+	if err != nil {
+		return fmt.Errorf("create main TS file failed：%s", err.Error())
+	}
+	//noinspection GoUnhandledErrorResult
+	defer mFile.Close()
+	writer := bufio.NewWriter(mFile)
+
+	/*录制时长到达时取消进行中的下载，重试中的分片不会阻塞录制*/
+	runCtx := ctx
+	if duration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	stopped := func() {
+		if ctx.Err() != nil {
+			tool.Log().Info("recording interrupted")
+		} else {
+			tool.Log().Info("recording duration reached", "duration", duration)
+		}
+	}
+
+	/*每轮等待所有分片结束后才重新加载playlist，无限重试会使窗口滑过后续分片*/
+	if maxTries <= 0 {
+		maxTries = liveMaxTries
+	}
+
+	/*首次加载的playlist中的分片已在队列中*/
+	current := d.result
+	if n := len(current.M3u8.Segments); n > 0 {
+		d.nextSeq = current.M3u8.Segments[n-1].Sequence + 1
+	}
+
+	written := 0
+	for {
+		/*下载本轮新增的分片，并按序追加到输出文件*/
+		interrupted := d.run(runCtx, concurrency, false, maxTries) != nil
+		if written, err = d.appendOutput(writer, written); err != nil {
+			return err
+		}
+		if interrupted {
+			stopped()
+			break
+		}
+		if current.M3u8.EndList {
+			tool.Log().Info("recording reached end of playlist")
+			break
+		}
+
+		wait := reloadInterval(current.M3u8)
+		stop := false
+		for !stop {
+			select {
+			case <-runCtx.Done():
+				stopped()
+				stop = true
+				continue
+			case <-time.After(wait):
+			}
+
+			/*重新加载playlist*/
+			fresh, err := parse.Reload(current)
+			if err != nil {
+				tool.Log().Warn("reload playlist failed", "error", err)
+				continue
+			}
+			current = fresh
+			if d.appendSegments(current) > 0 || current.M3u8.EndList {
+				break
+			}
+			/*无新分片，按照RFC 8216以target duration的一半重试*/
+			wait = reloadInterval(current.M3u8) / 2
+		}
+		if stop {
+			break
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("write to %s: %s", mFilePath, err.Error())
+	}
+	// Remove `ts` folder
+	_ = os.RemoveAll(d.tsFolder)
+	tool.Log().Info("output written", "path", mFilePath, "segments", written)
+	return nil
+}
+
+/*将新playlist中尚未下载的分片加入队列，返回新增的分片数*/
+func (d *Downloader) appendSegments(r *parse.Result) int {
+	d.lock.Lock()
+	added := 0
+	var lost uint64
+	/*最新的分片也早于已录制的分片: media sequence回退(如编码器重启)，按新的编号继续录制*/
+	restarted := false
+	previous := d.nextSeq
+	if n := len(r.M3u8.Segments); n > 0 && r.M3u8.Segments[n-1].Sequence+1 < d.nextSeq {
+		restarted = true
+		d.nextSeq = r.M3u8.Segments[0].Sequence
+	}
+	for _, seg := range r.M3u8.Segments {
+		if seg.Sequence < d.nextSeq {
+			continue
+		}
+		/*上一轮下载期间窗口滑过的分片已无法获取*/
+		if seg.Sequence > d.nextSeq {
+			lost += seg.Sequence - d.nextSeq
+		}
+		s := *seg
+		s.KeyIndex = d.importKey(r, seg.KeyIndex)
+		if restarted && added == 0 {
+			s.Discontinuity = true
+		}
+		d.result.M3u8.Segments = append(d.result.M3u8.Segments, &s)
+		d.queue = append(d.queue, &FileSlice{segId: d.segLen, tries: 0})
+		d.segLen++
+		d.nextSeq = seg.Sequence + 1
+		added++
+	}
+	d.lock.Unlock()
+	if restarted {
+		tool.Log().Warn("media sequence went backwards, restarting numbering", "previous", previous, "sequence", r.M3u8.Segments[0].Sequence)
+		d.emit(Event{Type: EventWarning, Segment: -1, Message: "media sequence went backwards", Total: d.segLen})
+	}
+	if lost > 0 {
+		tool.Log().Warn("segments left the live window before being loaded", "lost", lost)
+		d.emitMissing("segments left the live window before being loaded", -1, int(lost))
+	}
+	return added
+}
+
+/*将r中keyIndex号key并入d.result，返回其在d.result中的编号*/
+func (d *Downloader) importKey(r *parse.Result, keyIndex int) int {
+	key, ok := r.M3u8.Keys[keyIndex]
+	if !ok {
+		return 0
+	}
+	for idx, k := range d.result.M3u8.Keys {
+		if k.Method == key.Method && k.URI == key.URI && k.IV == key.IV {
+			return idx
+		}
+	}
+	idx := len(d.result.M3u8.Keys) + 1
+	d.result.M3u8.Keys[idx] = key
+	if v, ok := r.Keys[keyIndex]; ok {
+		d.result.Keys[idx] = v
+	}
+	return idx
+}
+
+/*将[from, segLen)号分片按序追加到输出，返回已写出的分片数*/
+func (d *Downloader) appendOutput(w *bufio.Writer, from int) (int, error) {
+	for segIndex := from; segIndex < d.segLen; segIndex++ {
+		if match, _ := d.isMatched(segIndex, "adjump"); match {
+			continue
+		}
+		f := filepath.Join(d.tsFolder, tsFilename(segIndex))
+		bytes, err := ioutil.ReadFile(f)
+		if err != nil {
+			tool.Log().Warn("segment file missing", "segment", segIndex)
+			d.emitMissing("segment file missing", segIndex, 1)
+			continue
+		}
+		if _, err := w.Write(bytes); err != nil {
+			return segIndex, fmt.Errorf("write segment %d: %s", segIndex, err.Error())
+		}
+		_ = os.Remove(f)
+	}
+	return d.segLen, w.Flush()
+}
+
+/*两次加载playlist的间隔*/
+func reloadInterval(m *parse.M3u8) time.Duration {
+	if m.TargetDuration <= 0 {
+		return defaultReloadInterval
+	}
+	return time.Duration(m.TargetDuration * float64(time.Second))
+}
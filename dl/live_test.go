@@ -0,0 +1,218 @@
+package dl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tsPacket returns one 188 bytes TS packet filled with b
+func tsPacket(b byte) []byte {
+	p := bytes.Repeat([]byte{b}, 188)
+	p[0] = 0x47
+	return p
+}
+
+func TestRecord(t *testing.T) {
+	var reloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			var n int
+			fmt.Sscanf(filepath.Base(r.URL.Path), "%d.ts", &n)
+			w.Write(tsPacket(byte(n)))
+			return
+		}
+		/*每次加载滑动一个分片，第三次加载时结束*/
+		n := atomic.AddInt32(&reloads, 1)
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.01\n#EXT-X-MEDIA-SEQUENCE:%d\n", n)
+		for i := n; i < n+2; i++ {
+			fmt.Fprintf(w, "#EXTINF:1.0,\n%d.ts\n", i)
+		}
+		if n == 3 {
+			fmt.Fprintln(w, "#EXT-X-ENDLIST")
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Record(2, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(d.folder, d.fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []byte
+	for i := 1; i <= 4; i++ {
+		expected = append(expected, tsPacket(byte(i))...)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("expected %d bytes of segments 1..4, result: %d bytes", len(expected), len(got))
+	}
+}
+
+func TestRecordDeadline(t *testing.T) {
+	var reloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/live.m3u8":
+			/*第二次加载时窗口已滑过3、4号分片*/
+			seq := 1
+			if atomic.AddInt32(&reloads, 1) > 1 {
+				seq = 5
+			}
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.01\n#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+			for i := seq; i < seq+2; i++ {
+				fmt.Fprintf(w, "#EXTINF:1.0,\n%d.ts\n", i)
+			}
+		case "/6.ts":
+			/*一直失败的分片重试至录制时长到达*/
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(tsPacket(1))
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetRetryBackoff(time.Millisecond, 10*time.Millisecond)
+	var lost int32
+	d.Subscribe(ObserverFunc(func(e Event) {
+		if e.Type == EventWarning && strings.Contains(e.Message, "live window") {
+			atomic.AddInt32(&lost, int32(e.Missing))
+		}
+	}))
+	start := time.Now()
+	if err := d.Record(1, -1, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("recording ignored its duration, took %s", elapsed)
+	}
+	if atomic.LoadInt32(&lost) != 2 {
+		t.Fatalf("expected 2 lost segments reported, result: %d", atomic.LoadInt32(&lost))
+	}
+}
+
+func TestRecordFailingSegment(t *testing.T) {
+	var reloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/live.m3u8":
+			/*第二次加载时结束*/
+			seq := 1
+			n := atomic.AddInt32(&reloads, 1)
+			if n > 1 {
+				seq = 3
+			}
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.01\n#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+			for i := seq; i < seq+2; i++ {
+				fmt.Fprintf(w, "#EXTINF:1.0,\n%d.ts\n", i)
+			}
+			if n > 1 {
+				fmt.Fprintln(w, "#EXT-X-ENDLIST")
+			}
+		case "/2.ts":
+			/*一直失败的分片，无限重试时会阻塞playlist的重新加载*/
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			var n int
+			fmt.Sscanf(filepath.Base(r.URL.Path), "%d.ts", &n)
+			w.Write(tsPacket(byte(n)))
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetRetryBackoff(time.Millisecond, 10*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Record(1, -1, 0)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("a failing segment blocked the recording")
+	}
+	got, err := ioutil.ReadFile(filepath.Join(d.folder, d.fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(tsPacket(1), tsPacket(3)...), tsPacket(4)...)
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("expected segments 1, 3 and 4, result: %d bytes", len(got))
+	}
+}
+
+func TestRecordSequenceRestart(t *testing.T) {
+	var reloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".ts") {
+			var n int
+			fmt.Sscanf(filepath.Base(r.URL.Path), "%d.ts", &n)
+			w.Write(tsPacket(byte(n)))
+			return
+		}
+		/*编码器重启后media sequence从0开始*/
+		seq := 10
+		n := atomic.AddInt32(&reloads, 1)
+		if n > 1 {
+			seq = 0
+		}
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.01\n#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+		for i := seq; i < seq+2; i++ {
+			fmt.Fprintf(w, "#EXTINF:1.0,\n%d.ts\n", i)
+		}
+		if n > 1 {
+			fmt.Fprintln(w, "#EXT-X-ENDLIST")
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/live.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings int32
+	d.Subscribe(ObserverFunc(func(e Event) {
+		if e.Type == EventWarning && strings.Contains(e.Message, "media sequence") {
+			atomic.AddInt32(&warnings, 1)
+		}
+	}))
+	if err := d.Record(1, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&warnings) != 1 {
+		t.Fatalf("expected a warning about the media sequence, result: %d", atomic.LoadInt32(&warnings))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(d.folder, d.fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []byte
+	for _, n := range []byte{10, 11, 0, 1} {
+		expected = append(expected, tsPacket(n)...)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("expected segments 10, 11, 0 and 1, result: %d bytes", len(got))
+	}
+}
@@ -0,0 +1,97 @@
+package dl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/anlaneg/m3u8/mp4"
+	"github.com/anlaneg/m3u8/tool"
+)
+
+const mp4Ext = ".mp4"
+
+/*将所有分片按序demux，remux为mp4*/
+func (d *Downloader) remux() error {
+	missing, err := d.checkGaps()
+	if err != nil {
+		return err
+	}
+	var paths []string
+	skipCount := 0
+	for segIndex := 0; segIndex < d.segLen; segIndex++ {
+		if match, _ := d.isMatched(segIndex, "adjump"); match {
+			skipCount++
+			continue
+		}
+		if missing[segIndex] {
+			continue
+		}
+		paths = append(paths, filepath.Join(d.tsFolder, tsFilename(segIndex)))
+	}
+
+	mFilePath := d.outputPath()
+	fTemp := mFilePath + tsTempFileSuffix
+	f, err := os.Create(fTemp)
+	if err != nil {
+		return fmt.Errorf("create main MP4 file failed：%s", err.Error())
+	}
+	r := &segmentReader{paths: paths}
+	err = mp4.Remux(r, f)
+	r.close()
+	_ = f.Close()
+	if err != nil {
+		_ = os.Remove(fTemp)
+		return fmt.Errorf("remux to %s: %s", mFilePath, err.Error())
+	}
+	if err := os.Rename(fTemp, mFilePath); err != nil {
+		return err
+	}
+
+	tool.Log().Info("output written", "path", mFilePath, "segments", len(paths), "skip", skipCount)
+	if len(missing) > 0 {
+		return d.incomplete(len(missing), mFilePath)
+	}
+	// Remove `ts` folder
+	_ = os.RemoveAll(d.tsFolder)
+	return nil
+}
+
+/*依次读取多个分片文件，同一时刻只打开一个文件*/
+type segmentReader struct {
+	paths []string
+	cur   *os.File
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur = f
+			r.paths = r.paths[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.close()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *segmentReader) close() {
+	if r.cur != nil {
+		_ = r.cur.Close()
+		r.cur = nil
+	}
+}
@@ -0,0 +1,160 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+const partMetaSuffix = ".meta"
+
+/*未下载完成的分片原始内容的来源，用于续传时校验*/
+type partMeta struct {
+	URL          string `json:"url"`
+	Offset       uint64 `json:"offset"`
+	Length       uint64 `json:"length"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func loadPartMeta(path string) *partMeta {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	m := &partMeta{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil
+	}
+	return m
+}
+
+func (m *partMeta) save(path string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0666)
+}
+
+/*续传时使用的If-Range*/
+func (m *partMeta) validator() string {
+	r := tool.RangeResponse{ETag: m.ETag, LastModified: m.LastModified}
+	return r.Validator()
+}
+
+/*删除原始内容及其来源*/
+func removePart(raw string) {
+	_ = os.Remove(raw)
+	_ = os.Remove(raw + partMetaSuffix)
+}
+
+/*将segIndex号分片的原始内容下载到raw；raw中已有的部分按Range续传，对端不支持或内容已变化时重新下载*/
+func (d *Downloader) fetch(ctx context.Context, segIndex int, raw string) error {
+	sf := d.result.M3u8.Segments[segIndex]
+	tsUrl := d.tsURL(segIndex)
+	meta := loadPartMeta(raw + partMetaSuffix)
+	var have uint64
+	if info, err := os.Stat(raw); err == nil && meta != nil && meta.URL == tsUrl &&
+		meta.Offset == sf.Offset && meta.Length == sf.Length && meta.validator() != "" {
+		have = uint64(info.Size())
+	}
+	if sf.Length > 0 && have >= sf.Length {
+		if have == sf.Length {
+			return nil
+		}
+		have = 0
+	}
+
+	/*请求tsurl，带有byte range时只请求对应子区间*/
+	start := sf.Offset + have
+	var length uint64
+	if sf.Length > 0 {
+		length = sf.Length - have
+	}
+	validator := ""
+	if have > 0 {
+		validator = meta.validator()
+	}
+	resp, err := d.client.GetResumeContext(ctx, tsUrl, start, length, validator)
+	var statusErr *tool.HTTPStatusError
+	if have > 0 && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		/*上次中断时已接收全部内容，对端声明的长度与已有部分一致*/
+		if sf.Length == 0 && statusErr.Size == int64(start) {
+			tool.Log().Debug("segment already received", "segment", segIndex, "size", have)
+			return nil
+		}
+		/*已有部分与对端内容不符，丢弃后从头下载*/
+		tool.Log().Info("range not satisfiable, downloading again", "segment", segIndex, "offset", have)
+		removePart(raw)
+		return d.fetch(ctx, segIndex, raw)
+	}
+	if err != nil {
+		return fmt.Errorf("request %s, %w", tsUrl, err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	/*校验对端声明的长度与请求的区间*/
+	if resp.Length >= 0 {
+		switch {
+		case resp.Offset == start && length > 0 && uint64(resp.Length) != length:
+			return fmt.Errorf("%w: %s, Content-Length %d, requested %d bytes", ErrInvalidSegment, tsUrl, resp.Length, length)
+		case resp.Offset != start && sf.Length > 0 && uint64(resp.Length) < sf.Offset+sf.Length:
+			return fmt.Errorf("%w: %s, Content-Length %d, byte range %d@%d", ErrInvalidSegment, tsUrl, resp.Length, sf.Length, sf.Offset)
+		}
+	}
+
+	var body io.Reader = resp.Body
+	if resp.Offset != start {
+		/*对端返回了完整内容，从头下载并跳过byte range之前的部分*/
+		if have > 0 {
+			tool.Log().Info("segment changed or range not supported, downloading again", "segment", segIndex, "offset", have)
+		}
+		have = 0
+		if _, err := io.CopyN(ioutil.Discard, body, int64(sf.Offset)); err != nil {
+			return fmt.Errorf("request %s, skip %d bytes: %s", tsUrl, sf.Offset, err.Error())
+		}
+	} else if have > 0 {
+		tool.Log().Debug("segment resumed", "segment", segIndex, "offset", have)
+	}
+	if sf.Length > 0 {
+		body = io.LimitReader(body, int64(sf.Length-have))
+	}
+	if have == 0 {
+		/*记录来源，中断后据此续传*/
+		meta = &partMeta{URL: tsUrl, Offset: sf.Offset, Length: sf.Length, ETag: resp.ETag, LastModified: resp.LastModified}
+		if err := meta.save(raw + partMetaSuffix); err != nil {
+			return fmt.Errorf("save %s: %s", raw+partMetaSuffix, err.Error())
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if have == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(raw, flag, 0666)
+	if err != nil {
+		return fmt.Errorf("create file: %s, %s", raw, err.Error())
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	counter := &countingReader{r: body}
+	if _, err := d.write(f, counter); err != nil {
+		return fmt.Errorf("download %s to %s: %s", tsUrl, raw, err.Error())
+	}
+	if sf.Length > 0 && have+counter.n != sf.Length {
+		return fmt.Errorf("%w: byte range %d@%d of %s, received %d bytes", ErrInvalidSegment, sf.Length, sf.Offset, tsUrl, have+counter.n)
+	}
+	if sf.Length == 0 && resp.Length >= 0 && counter.n != uint64(resp.Length) {
+		return fmt.Errorf("%w: %s, Content-Length %d, received %d bytes", ErrInvalidSegment, tsUrl, resp.Length, counter.n)
+	}
+	return f.Close()
+}
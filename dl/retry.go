@@ -0,0 +1,64 @@
+package dl
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+const (
+	defaultRetryBase = time.Second
+	defaultRetryMax  = time.Minute
+)
+
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetRetryBackoff sets the delay before the first retry of a segment, doubled
+// on every further retry up to max. A Retry-After header asking for a longer
+// delay takes precedence.
+func (d *Downloader) SetRetryBackoff(base time.Duration, max time.Duration) {
+	d.retryBase = base
+	d.retryMax = max
+}
+
+/*tries次失败后的重试延迟：指数退避，取[delay/2, delay)内的随机值，避免所有分片同时重试*/
+func (d *Downloader) retryDelay(tries int, err error) time.Duration {
+	delay := d.retryBase
+	for i := 1; i < tries && delay < d.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > d.retryMax {
+		delay = d.retryMax
+	}
+	if delay > 1 {
+		jitterLock.Lock()
+		delay = delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+		jitterLock.Unlock()
+	}
+	var statusErr *tool.HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+	return delay
+}
+
+/*判断err是否值得重试：解密失败及4xx(除408、429)重试也不会成功*/
+func retryable(err error) bool {
+	var statusErr *tool.HTTPStatusError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, ErrDecrypt):
+		return false
+	case errors.As(err, &statusErr):
+		return statusErr.Temporary()
+	}
+	return true
+}
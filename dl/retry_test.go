@@ -0,0 +1,94 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXTINF:10,\nbusy.ts\n#EXTINF:10,\ngone.ts\n#EXT-X-ENDLIST\n"
+	var lock sync.Mutex
+	var busy []time.Time
+	gone := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/busy.ts":
+			/*前两次返回429，要求等待1秒*/
+			busy = append(busy, time.Now())
+			if len(busy) <= 2 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write(tsPacket(0))
+		case "/gone.ts":
+			gone++
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewTask(t.TempDir(), srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetRetryBackoff(10*time.Millisecond, 20*time.Millisecond)
+	d.SetAllowGaps(true)
+	/*不限重试次数时404也只请求一次*/
+	if err := d.Start(2, false, -1); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected incomplete download, result: %v", err)
+	}
+	if gone != 1 {
+		t.Fatalf("expected 404 not to be retried, requested %d times", gone)
+	}
+	if len(busy) != 3 {
+		t.Fatalf("expected 3 requests of busy.ts, result: %d", len(busy))
+	}
+	for i := 1; i < len(busy); i++ {
+		if gap := busy[i].Sub(busy[i-1]); gap < time.Second {
+			t.Fatalf("retry %d after %s, expected Retry-After of 1s", i, gap)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := &Downloader{retryBase: 100 * time.Millisecond, retryMax: time.Second}
+	/*每次翻倍，不超过retryMax，随机落在[max/2, max]*/
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		tries := i + 1
+		max *= time.Millisecond
+		delay := d.retryDelay(tries, errors.New("reset"))
+		if delay < max/2 || delay > max {
+			t.Fatalf("tries %d: delay %s not in [%s, %s]", tries, delay, max/2, max)
+		}
+	}
+	err := fmt.Errorf("request: %w", &tool.HTTPStatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 5 * time.Second})
+	if delay := d.retryDelay(1, err); delay != 5*time.Second {
+		t.Fatalf("expected Retry-After delay, result: %s", delay)
+	}
+	for _, c := range []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset"), true},
+		{err, true},
+		{&tool.HTTPStatusError{StatusCode: http.StatusForbidden}, false},
+		{fmt.Errorf("%w: invalid IV", ErrDecrypt), false},
+	} {
+		if retryable(c.err) != c.retryable {
+			t.Fatalf("%v: expected retryable %v", c.err, c.retryable)
+		}
+	}
+}
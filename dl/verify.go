@@ -0,0 +1,229 @@
+package dl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anlaneg/m3u8/ts"
+)
+
+/*相邻两个PES的DTS相差超过此值(90kHz)时视为时间戳跳变*/
+const maxTimestampGap = 90000
+
+/*33位时间戳回绕*/
+const timestampWrap = int64(1) << 33
+
+// SegmentStatus is the verdict of Verify on a segment
+type SegmentStatus string
+
+const (
+	// SegmentOK is a finished segment whose file is a valid transport stream
+	SegmentOK SegmentStatus = "ok"
+	// SegmentPending is not finished yet, a file left without state is not trusted
+	SegmentPending SegmentStatus = "pending"
+	// SegmentMissing is recorded as finished but its file is gone
+	SegmentMissing SegmentStatus = "missing"
+	// SegmentChanged has a file whose size or SHA-256 differs from the recorded one
+	SegmentChanged SegmentStatus = "changed"
+	// SegmentInvalid has a file that is not a whole number of TS packets
+	SegmentInvalid SegmentStatus = "invalid"
+	// SegmentEncrypted is a finished segment kept encrypted (SetKeepEncrypted),
+	// its size and SHA-256 match but its packets can not be checked
+	SegmentEncrypted SegmentStatus = "encrypted"
+)
+
+// SegmentReport is the result of verifying the file of a segment
+type SegmentReport struct {
+	Index  int
+	URL    string
+	Status SegmentStatus
+	// Detail explains a status other than ok
+	Detail  string
+	Packets int
+	// CCErrors counts continuity_counter errors, packets lost or reordered
+	CCErrors int
+	// TimestampGaps counts jumps of the decoding timestamps of a stream,
+	// forward by more than a second or backward, MaxGap is the largest one
+	TimestampGaps int
+	MaxGap        time.Duration
+}
+
+// NeedsRedownload reports whether the segment must be downloaded (again).
+// CC errors and timestamp gaps are not counted, they may come from the source.
+func (r *SegmentReport) NeedsRedownload() bool {
+	return r.Status != SegmentOK && r.Status != SegmentEncrypted
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	Folder   string
+	URL      string
+	Segments []*SegmentReport
+}
+
+// Redownload returns the indexes of the segments to download (again)
+func (r *VerifyReport) Redownload() []int {
+	var indexes []int
+	for _, s := range r.Segments {
+		if s.NeedsRedownload() {
+			indexes = append(indexes, s.Index)
+		}
+	}
+	return indexes
+}
+
+// Verify checks the segments of the download in folder without network access:
+// the files in ts/ against ts/.finished (presence, size and SHA-256), their
+// transport stream packets, continuity counters and timestamps
+func Verify(folder string) (*VerifyReport, error) {
+	tsFolder := filepath.Join(folder, tsFolderName)
+	path := filepath.Join(tsFolder, finishStateFileName)
+	if exist, _ := path_exists(path); !exist {
+		return nil, fmt.Errorf("no download state '%s', nothing to verify", path)
+	}
+	f, err := load(path)
+	if err != nil {
+		return nil, fmt.Errorf("load finish state '[%s]' failed: %s", path, err.Error())
+	}
+
+	/*版本1及早期的状态未记录分片数，以最大的编号为准*/
+	count := f.count
+	for idx := range f.state {
+		if idx >= count {
+			count = idx + 1
+		}
+	}
+	report := &VerifyReport{Folder: folder, URL: f.url}
+	for idx := 0; idx < count; idx++ {
+		report.Segments = append(report.Segments, verifySegment(tsFolder, idx, f.state[idx]))
+	}
+	return report, nil
+}
+
+/*校验idx号分片，s为其完成状态，未完成时为nil*/
+func verifySegment(tsFolder string, idx int, s *SegmentState) *SegmentReport {
+	r := &SegmentReport{Index: idx, Status: SegmentOK}
+	file := filepath.Join(tsFolder, tsFilename(idx))
+	if s != nil {
+		r.URL = s.URL
+	}
+	exist, _ := path_exists(file)
+	switch {
+	case s == nil && !exist:
+		r.Status = SegmentPending
+		return r
+	case s == nil:
+		r.Status = SegmentPending
+		r.Detail = "file not recorded as finished"
+	case !exist:
+		r.Status = SegmentMissing
+		r.Detail = "file not found"
+		return r
+	default:
+		if _, _, err := verifySegmentFile(file, s, true); err != nil {
+			r.Status = SegmentChanged
+			r.Detail = err.Error()
+		} else if s.Encrypted {
+			/*加密的内容不是TS，只能校验大小与摘要*/
+			r.Status = SegmentEncrypted
+			r.Detail = "kept encrypted, packets not checked"
+			return r
+		}
+	}
+
+	if err := r.checkPackets(file); err != nil && r.Status == SegmentOK {
+		r.Status = SegmentInvalid
+		r.Detail = err.Error()
+	}
+	if err := r.checkTimestamps(file); err != nil && r.Status == SegmentOK {
+		r.Status = SegmentInvalid
+		r.Detail = err.Error()
+	}
+	return r
+}
+
+/*逐个检查packet的同步字节与continuity_counter*/
+func (r *SegmentReport) checkPackets(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, 64*ts.PacketSize)
+	cc := ts.NewContinuityChecker()
+	buf := make([]byte, ts.PacketSize)
+	for {
+		n, err := io.ReadFull(br, buf)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%d bytes is not a multiple of %d", r.Packets*ts.PacketSize+n, ts.PacketSize)
+		}
+		if err != nil {
+			return err
+		}
+		p, err := ts.ParsePacket(buf)
+		if err != nil {
+			return fmt.Errorf("packet %d: %s", r.Packets, err.Error())
+		}
+		r.Packets++
+		if !cc.Check(p) {
+			r.CCErrors++
+		}
+	}
+	if r.Packets == 0 {
+		return fmt.Errorf("no transport stream packet")
+	}
+	return nil
+}
+
+/*按stream检查相邻PES的DTS是否跳变*/
+func (r *SegmentReport) checkTimestamps(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+
+	demuxer := ts.NewDemuxer(f)
+	last := make(map[uint16]int64)
+	for {
+		pes, err := demuxer.ReadPES()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !pes.HasPTS {
+			continue
+		}
+		prev, ok := last[pes.PID]
+		last[pes.PID] = pes.DTS
+		if !ok {
+			continue
+		}
+		gap := pes.DTS - prev
+		/*时间戳回绕*/
+		if gap < -timestampWrap/2 {
+			gap += timestampWrap
+		}
+		if gap > maxTimestampGap || gap < 0 {
+			r.TimestampGaps++
+			if gap < 0 {
+				gap = -gap
+			}
+			if d := time.Duration(gap) * time.Second / 90000; d > r.MaxGap {
+				r.MaxGap = d
+			}
+		}
+	}
+}
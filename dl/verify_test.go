@@ -0,0 +1,201 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anlaneg/m3u8/tool"
+)
+
+/*PAT、PMT及每个dts一个单packet音频PES组成的TS*/
+func pesStream(dts ...int64) []byte {
+	var b []byte
+	cc := make(map[uint16]byte)
+	packet := func(pid uint16, payload []byte) {
+		p := bytes.Repeat([]byte{0xff}, 188)
+		p[0], p[1], p[2] = 0x47, 0x40|byte(pid>>8), byte(pid)
+		p[3] = 0x30 | cc[pid]&0x0f
+		cc[pid]++
+		p[4] = byte(183 - len(payload))
+		p[5] = 0
+		copy(p[188-len(payload):], payload)
+		b = append(b, p...)
+	}
+	section := func(tableID byte, body []byte) []byte {
+		length := 5 + len(body) + 4
+		s := []byte{0, tableID, 0xb0 | byte(length>>8), byte(length), 0, 1, 0xc1, 0, 0}
+		s = append(s, body...)
+		return append(s, 0, 0, 0, 0)
+	}
+	packet(0, section(0x00, []byte{0, 1, 0xe1, 0x00}))
+	packet(0x100, section(0x02, []byte{0xe1, 0x01, 0xf0, 0, 0x0f, 0xe1, 0x01, 0xf0, 0}))
+	for _, ts := range dts {
+		data := bytes.Repeat([]byte{0xaa}, 10)
+		pes := []byte{0, 0, 1, 0xc0, 0, byte(3 + 5 + len(data)), 0x80, 0x80, 5,
+			0x21 | byte(ts>>29&0x0e), byte(ts >> 22), byte(ts>>14) | 1, byte(ts >> 7), byte(ts<<1) | 1}
+		packet(0x101, append(pes, data...))
+	}
+	return b
+}
+
+func TestVerify(t *testing.T) {
+	valid := pesStream(0, 1920, 3840)
+	/*丢失一个packet*/
+	lost := pesStream(0, 1920, 3840, 5760)
+	lost = append(lost[:3*188], lost[4*188:]...)
+	segments := map[string][]byte{
+		"/0.ts": valid,
+		"/1.ts": pesStream(0, 1920, 900000),
+		"/2.ts": valid,
+		"/3.ts": valid,
+		"/4.ts": valid,
+		"/5.ts": lost,
+	}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n"
+	for i := 0; i < len(segments); i++ {
+		playlist += fmt.Sprintf("#EXTINF:10,\n%d.ts\n", i)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, playlist)
+			return
+		}
+		w.Write(segments[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	folder := t.TempDir()
+	d, err := NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	/*4号分片未下载*/
+	for _, idx := range []int{0, 1, 2, 3, 5} {
+		s, err := d.download(context.Background(), idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.updateFinishState(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(d.tsFolder, tsFilename(2))); err != nil {
+		t.Fatal(err)
+	}
+	changed := append([]byte(nil), valid...)
+	changed[len(changed)-1] = 0
+	if err := ioutil.WriteFile(filepath.Join(d.tsFolder, tsFilename(3)), changed, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Segments) != len(segments) {
+		t.Fatalf("expected %d segments, result: %d", len(segments), len(report.Segments))
+	}
+	expected := []SegmentStatus{SegmentOK, SegmentOK, SegmentMissing, SegmentChanged, SegmentPending, SegmentOK}
+	for idx, s := range report.Segments {
+		if s.Status != expected[idx] {
+			t.Fatalf("segment %d: expected %s, result: %s (%s)", idx, expected[idx], s.Status, s.Detail)
+		}
+	}
+	if s := report.Segments[0]; s.Packets != 5 || s.CCErrors != 0 || s.TimestampGaps != 0 {
+		t.Fatalf("unexpected report of a valid segment: %+v", s)
+	}
+	if s := report.Segments[1]; s.TimestampGaps != 1 || s.MaxGap < 9*time.Second {
+		t.Fatalf("expected a timestamp gap of about 10s, result: %+v", s)
+	}
+	if s := report.Segments[5]; s.CCErrors != 1 {
+		t.Fatalf("expected a continuity counter error, result: %+v", s)
+	}
+	if got := report.Redownload(); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Fatalf("expected segments 2, 3 and 4 to download again, result: %v", got)
+	}
+
+	if _, err := Verify(t.TempDir()); err == nil {
+		t.Fatal("expected an error without download state")
+	}
+}
+
+func TestVerifyKeptEncrypted(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := make([]byte, 16)
+	encrypted, err := tool.AES128Encrypt(pesStream(0, 1920), key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"k.key\",IV=0x00000000000000000000000000000000\n" +
+		"#EXTINF:10,\n0.ts\n#EXTINF:10,\n1.ts\n#EXT-X-ENDLIST\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, playlist)
+		case "/k.key":
+			w.Write(key)
+		default:
+			w.Write(encrypted)
+		}
+	}))
+	defer srv.Close()
+
+	folder := t.TempDir()
+	d, err := NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetKeepEncrypted(true)
+	for idx := 0; idx < 2; idx++ {
+		s, err := d.download(context.Background(), idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.Encrypted {
+			t.Fatalf("segment %d: expected to be recorded as kept encrypted", idx)
+		}
+		if err := d.updateFinishState(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/*加密的内容仍按大小与摘要校验*/
+	changed := append([]byte(nil), encrypted...)
+	changed[0] ^= 0xff
+	if err := ioutil.WriteFile(filepath.Join(d.tsFolder, tsFilename(1)), changed, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := report.Segments[0]; s.Status != SegmentEncrypted || s.NeedsRedownload() {
+		t.Fatalf("expected an encrypted segment not to download again, result: %+v", s)
+	}
+	if s := report.Segments[1]; s.Status != SegmentChanged {
+		t.Fatalf("expected a changed segment, result: %+v", s)
+	}
+	if got := report.Redownload(); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("expected segment 1 to download again, result: %v", got)
+	}
+
+	/*续传时保留加密状态*/
+	d, err = NewTask(folder, srv.URL+"/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := d.finishState.state[0]; s == nil || !s.Encrypted {
+		t.Fatalf("expected segment 0 to stay kept encrypted after resume, result: %+v", s)
+	}
+}
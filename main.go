@@ -1,75 +1,463 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/anlaneg/m3u8/dl"
+	"github.com/anlaneg/m3u8/parse"
+	"github.com/anlaneg/m3u8/tool"
 )
 
 var (
 	url          string
 	output       string
 	chanSize     int
+	adaptive     bool
+	minWorkers   int
+	maxWorkers   int
 	continueFlag bool
 	maxTries     int
+	retryDelay   time.Duration
+	retryMax     time.Duration
+	liveFlag     bool
+	duration     time.Duration
+	variant      string
+	maxRes       string
+	codec        string
+	format       string
+	keepEncrypt  bool
+	allowGaps    bool
+	headers      headerFlags
+	cookieFile   string
+	referer      string
+	userAgent    string
+	limitRate    string
+	keyHex       string
+	keyFile      string
+	keyCmd       string
+	verbose      bool
+	quiet        bool
+	logFormat    string
+	outputFormat string
+	httpConfig   = tool.DefaultClientConfig
 )
 
+/*可重复的-H参数*/
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
 func init() {
 	flag.StringVar(&url, "u", "", "M3U8 URL, required")
 	flag.IntVar(&chanSize, "c", 5, "Maximum number of occurrences")
+	flag.BoolVar(&adaptive, "adaptive", false, "Adapt the number of workers to throughput and errors, starting from c")
+	flag.IntVar(&minWorkers, "min-c", 1, "Minimum number of workers with -adaptive")
+	flag.IntVar(&maxWorkers, "max-c", 0, "Maximum number of workers with -adaptive (default 4 times c)")
 	flag.StringVar(&output, "o", "", "Output folder, required")
 	flag.BoolVar(&continueFlag, "C", true, "continue download")
 	flag.IntVar(&maxTries, "m", -1, "Maximum number of try")
+	flag.DurationVar(&retryDelay, "retry-delay", time.Second, "Delay before retrying a failed segment, doubled on every retry")
+	flag.DurationVar(&retryMax, "retry-max", time.Minute, "Maximum delay between two retries of a segment")
+	flag.BoolVar(&liveFlag, "live", false, "Record a live or EVENT playlist by reloading it")
+	flag.DurationVar(&duration, "t", 0, "Maximum recording time in live mode, e.g. 30m (0 means until end of list or Ctrl-C)")
+	flag.StringVar(&variant, "variant", "first", "Variant of a master playlist: first, highest, lowest or its index")
+	flag.StringVar(&maxRes, "max-res", "", "Skip variants with a resolution larger than WxH, e.g. 1280x720")
+	flag.StringVar(&codec, "codec", "", "Only keep variants with this codec, e.g. avc1, hvc1")
+	flag.StringVar(&format, "format", "ts", "Output format: ts (merged file), mp4 (remuxed file) or hls (segments with a local index.m3u8)")
+	flag.BoolVar(&keepEncrypt, "keep-encrypted", false, "Keep segments encrypted and store their keys locally, hls format only")
+	flag.BoolVar(&allowGaps, "allow-gaps", false, "Write the output even if segments are missing, with a .gaps.txt report of the missing time ranges")
+	flag.StringVar(&keyHex, "key", "", "Decryption key as 32 hex digits, used instead of requesting key URIs")
+	flag.StringVar(&keyFile, "key-file", "", "File holding the decryption key (16 bytes or 32 hex digits)")
+	flag.StringVar(&keyCmd, "key-cmd", "", "Command printing the decryption key within 30s, split on whitespace (no quoting), the key URL is passed as last argument")
+	flag.StringVar(&outputFormat, "output-format", "text", "Progress output on stdout: text (progress bar) or json (one event per line)")
+	addHTTPFlags(flag.CommandLine)
+	addLogFlags(flag.CommandLine)
+}
+
+// Exit codes of the command, also listed in README
+const (
+	exitFailure     = 1   // any other error
+	exitUsage       = 2   // invalid parameters, as for flag parsing errors
+	exitExists      = 3   // the output already exists
+	exitNetwork     = 4   // a request failed or the server answered an error status
+	exitKeyFetch    = 5   // a decryption key could not be fetched
+	exitDecrypt     = 6   // a segment could not be decrypted
+	exitIncomplete  = 7   // segments are missing for another reason: output refused (run again to resume) or written without them with -allow-gaps
+	exitNoSegments  = 8   // the playlist has no segment
+	exitInterrupted = 130 // 128 + SIGINT
+)
+
+/*信息写到stderr并以code退出*/
+func exit(code int, v ...interface{}) {
+	fmt.Fprintln(os.Stderr, v...)
+	os.Exit(code)
+}
+
+/*参数错误*/
+func usage(v ...interface{}) {
+	exit(exitUsage, v...)
+}
+
+/*按错误类型选择退出码*/
+func fatal(err error) {
+	exit(exitCode(err), err)
+}
+
+/*放弃的分片包装在IncompleteError中，按其最后的错误分类，原因不明时为exitIncomplete*/
+func exitCode(err error) int {
+	var statusErr *tool.HTTPStatusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, parse.ErrKeyFetch):
+		return exitKeyFetch
+	case errors.Is(err, dl.ErrDecrypt):
+		return exitDecrypt
+	case errors.Is(err, parse.ErrNoSegments):
+		return exitNoSegments
+	case errors.As(err, &statusErr), errors.As(err, &netErr):
+		return exitNetwork
+	case errors.Is(err, dl.ErrIncomplete):
+		return exitIncomplete
+	}
+	return exitFailure
+}
+
+/*日志参数*/
+func addLogFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&verbose, "v", false, "Verbose output, including debug logs")
+	fs.BoolVar(&quiet, "q", false, "Quiet output, only errors and no progress bar")
+	fs.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+}
+
+/*根据日志参数设置logger，日志写到stderr*/
+func setupLogger() error {
+	opts := tool.LogOptions{Level: tool.LevelInfo}
+	switch {
+	case verbose && quiet:
+		return fmt.Errorf("parameters 'v' and 'q' are exclusive")
+	case verbose:
+		opts.Level = tool.LevelDebug
+	case quiet:
+		opts.Level = tool.LevelError
+	}
+	switch logFormat {
+	case "text":
+	case "json":
+		opts.JSON = true
+	default:
+		return fmt.Errorf("unknown log format: %s", logFormat)
+	}
+	tool.SetLogger(tool.NewLogger(os.Stderr, opts))
+	return nil
+}
+
+/*所有请求共用的HTTP参数*/
+func addHTTPFlags(fs *flag.FlagSet) {
+	fs.Var(&headers, "H", "Extra HTTP header 'Name: value' for all requests, repeatable")
+	fs.StringVar(&cookieFile, "cookies", "", "Netscape format cookie file")
+	fs.StringVar(&referer, "referer", "", "Referer header for all requests")
+	fs.StringVar(&userAgent, "ua", "", "User-Agent header for all requests")
+	fs.StringVar(&limitRate, "limit-rate", "", "Maximum download rate shared by all requests, e.g. 500K or 2M bytes per second")
+	fs.StringVar(&httpConfig.Proxy, "proxy", "", "HTTP or SOCKS5 proxy, e.g. socks5://127.0.0.1:1080 (default from environment)")
+	fs.DurationVar(&httpConfig.ConnectTimeout, "connect-timeout", httpConfig.ConnectTimeout, "Timeout of establishing a connection")
+	fs.DurationVar(&httpConfig.ReadTimeout, "read-timeout", httpConfig.ReadTimeout, "Timeout of waiting for data, not of a whole request")
+	fs.IntVar(&httpConfig.MaxIdleConnsPerHost, "max-idle", 0, "Maximum idle connections per host (default the value of c)")
+	fs.StringVar(&httpConfig.CAFile, "cacert", "", "Extra PEM CA bundle to trust")
+	fs.StringVar(&httpConfig.CertFile, "cert", "", "PEM client certificate")
+	fs.StringVar(&httpConfig.KeyFile, "cert-key", "", "PEM key of the client certificate")
+	fs.BoolVar(&httpConfig.Insecure, "insecure", false, "Skip verification of server certificates")
+}
+
+/*根据-key、-key-file、-key-cmd参数创建key provider，未指定时返回nil*/
+func keyProvider() (parse.KeyProvider, error) {
+	var providers parse.KeyProviders
+	if keyHex != "" {
+		p, err := parse.NewHexKeyProvider(keyHex)
+		if err != nil {
+			return nil, fmt.Errorf("parameter 'key': %s", err.Error())
+		}
+		providers = append(providers, p)
+	}
+	if keyFile != "" {
+		providers = append(providers, &parse.FileKeyProvider{Path: keyFile})
+	}
+	if keyCmd != "" {
+		providers = append(providers, &parse.ExecKeyProvider{Command: keyCmd})
+	}
+	if len(providers) == 0 {
+		return nil, nil
+	}
+	return providers, nil
+}
+
+/*根据HTTP参数创建client*/
+func httpClient() (*tool.Client, error) {
+	header, err := tool.ParseHeader(headers)
+	if err != nil {
+		return nil, err
+	}
+	if referer != "" {
+		header.Set("Referer", referer)
+	}
+	if userAgent != "" {
+		header.Set("User-Agent", userAgent)
+	}
+	if httpConfig.MaxIdleConnsPerHost <= 0 {
+		httpConfig.MaxIdleConnsPerHost = chanSize
+		if adaptive {
+			httpConfig.MaxIdleConnsPerHost = maxWorkers
+		}
+	}
+	client, err := tool.NewClient(httpConfig)
+	if err != nil {
+		return nil, err
+	}
+	client.Header = header
+	/*所有请求共用一个令牌桶*/
+	rate, err := tool.ParseRate(limitRate)
+	if err != nil {
+		return nil, err
+	}
+	client.Limiter = tool.NewLimiter(rate)
+	if cookieFile != "" {
+		jar, err := tool.LoadCookieJar(cookieFile)
+		if err != nil {
+			return nil, fmt.Errorf("load cookie file %s: %s", cookieFile, err.Error())
+		}
+		client.Jar = jar
+	}
+	return client, nil
 }
 
 func main() {
+	/*子命令*/
+	if len(os.Args) > 1 && os.Args[1] == "list-variants" {
+		listVariants(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verify(os.Args[2:])
+		return
+	}
+
 	/*命令行解析*/
 	flag.Parse()
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("[error]", r)
-			os.Exit(0)
+			exit(exitFailure, "[error]", r)
 		}
 	}()
 
 	/*参数检查*/
 	if url == "" {
-		panic("parameter '" + "u" + "' is required")
-		os.Exit(0)
+		usage("parameter 'u' is required")
 	}
 	if output == "" {
-		panic("parameter '" + "o" + "' is required")
-		os.Exit(0)
+		usage("parameter 'o' is required")
 	}
 	if chanSize <= 0 {
-		fmt.Println("parameter 'c' must be greater than 0")
-		os.Exit(0)
+		usage("parameter 'c' must be greater than 0")
+	}
+	if maxWorkers <= 0 {
+		maxWorkers = 4 * chanSize
+	}
+	if adaptive && (minWorkers <= 0 || minWorkers > maxWorkers) {
+		usage("parameters 'min-c' and 'max-c' must satisfy 0 < min-c <= max-c")
 	}
 	if maxTries <= 0 {
 		maxTries = -1
 	}
+	if err := setupLogger(); err != nil {
+		usage(err)
+	}
+	if outputFormat != "text" && outputFormat != "json" {
+		usage("unknown output format: " + outputFormat)
+	}
+
+	policy, index, err := parse.ParseVariantPolicy(variant)
+	if err != nil {
+		usage(err)
+	}
+	client, err := httpClient()
+	if err != nil {
+		fatal(err)
+	}
+	keys, err := keyProvider()
+	if err != nil {
+		usage(err)
+	}
+	opt := &parse.Options{
+		Client:      client,
+		KeyProvider: keys,
+		Variant: parse.VariantSelector{
+			Policy:        policy,
+			Index:         index,
+			MaxResolution: maxRes,
+			Codec:         codec,
+		},
+	}
 
 	/*创建 downloader task*/
-	downloader, err := dl.NewTask(output, url)
+	downloader, err := dl.NewTaskWithOptions(output, url, opt)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(0)
+		fatal(err)
+	}
+
+	if err := downloader.SetFormat(dl.Format(format)); err != nil {
+		usage(err)
+	}
+	if keepEncrypt && dl.Format(format) != dl.FormatHLS {
+		usage("parameter 'keep-encrypted' requires -format=hls")
+	}
+	if liveFlag && dl.Format(format) != dl.FormatTS {
+		usage("live recording only supports -format=ts")
+	}
+	downloader.SetKeepEncrypted(keepEncrypt)
+	downloader.SetAllowGaps(allowGaps)
+	downloader.SetRetryBackoff(retryDelay, retryMax)
+	if adaptive {
+		downloader.SetAdaptiveConcurrency(minWorkers, maxWorkers)
+	}
+	/*进度输出到stdout: json时每行一个事件，否则为终端进度条*/
+	switch {
+	case outputFormat == "json":
+		downloader.Subscribe(dl.NewJSONReporter(os.Stdout))
+	case !quiet:
+		downloader.Subscribe(dl.NewProgressBar())
 	}
 
 	if downloader.IsExist() {
-		fmt.Printf("*****%s****exists\n", downloader.GetFileName())
-		os.Exit(0)
+		exit(exitExists, fmt.Sprintf("*****%s****exists", downloader.GetFileName()))
+	}
+
+	/*SIGINT/SIGTERM取消下载，保存进度后退出；再次收到信号时直接退出*/
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	/*直播录制*/
+	if liveFlag {
+		if err := downloader.RecordContext(ctx, chanSize, maxTries, duration); err != nil {
+			fatal(err)
+		}
+		done()
+		return
 	}
 
 	/*执行download task*/
-	if err := downloader.Start(chanSize, continueFlag, maxTries); err != nil {
-		fmt.Println(err)
-		os.Exit(0)
+	if err := downloader.StartContext(ctx, chanSize, continueFlag, maxTries); err != nil {
+		if ctx.Err() != nil {
+			exit(exitInterrupted, "[interrupted] progress saved, run again with -C to resume")
+		}
+		fatal(err)
+	}
+	done()
+}
+
+/*json输出时stdout只包含事件*/
+func done() {
+	if outputFormat != "json" {
+		fmt.Println("Done!")
+	}
+}
+
+/*打印master playlist中的所有variant，不执行下载*/
+func listVariants(args []string) {
+	fs := flag.NewFlagSet("list-variants", flag.ExitOnError)
+	link := fs.String("u", "", "M3U8 URL, required")
+	addHTTPFlags(fs)
+	addLogFlags(fs)
+	_ = fs.Parse(args)
+	if *link == "" {
+		usage("parameter 'u' is required")
+	}
+	if err := setupLogger(); err != nil {
+		usage(err)
+	}
+	client, err := httpClient()
+	if err != nil {
+		fatal(err)
+	}
+
+	result, err := parse.Load(*link, &parse.Options{Client: client})
+	if err != nil {
+		fatal(err)
+	}
+	if len(result.M3u8.MasterPlaylist) == 0 {
+		fmt.Printf("%s is a media playlist (%d segments)\n", *link, len(result.M3u8.Segments))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tBANDWIDTH\tRESOLUTION\tCODECS\tURI")
+	for idx, mp := range result.M3u8.MasterPlaylist {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", idx, mp.BandWidth, mp.Resolution, mp.Codecs,
+			tool.ResolveURL(result.URL, mp.URI))
+	}
+	_ = w.Flush()
+}
+
+/*离线校验下载目录中的分片，需要重新下载时以exitIncomplete退出*/
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	all := fs.Bool("all", false, "List every segment, not only those with findings")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: m3u8 verify [-all] <folder>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	report, err := dl.Verify(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tSTATUS\tPACKETS\tCC_ERRORS\tTS_GAPS\tMAX_GAP\tDETAIL")
+	for _, s := range report.Segments {
+		if !*all && !s.NeedsRedownload() && s.CCErrors == 0 && s.TimestampGaps == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%s\t%s\n", s.Index, s.Status, s.Packets, s.CCErrors,
+			s.TimestampGaps, s.MaxGap, s.Detail)
+	}
+	_ = w.Flush()
+
+	redownload := report.Redownload()
+	if len(redownload) == 0 {
+		fmt.Printf("%d segments verified, none to download again\n", len(report.Segments))
+		return
+	}
+	indexes := make([]string, len(redownload))
+	for i, idx := range redownload {
+		indexes[i] = fmt.Sprint(idx)
 	}
-	fmt.Println("Done!")
+	fmt.Printf("%d of %d segments to download again: %s\n", len(redownload), len(report.Segments), strings.Join(indexes, ","))
+	os.Exit(exitIncomplete)
 }
 
 /*func panicParameter(name string) {
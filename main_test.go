@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anlaneg/m3u8/dl"
+	"github.com/anlaneg/m3u8/tool"
+)
+
+func TestExitCode(t *testing.T) {
+	packet := append([]byte{0x47, 0x01, 0x00, 0x10}, bytes.Repeat([]byte{0xff}, 184)...)
+	encrypted, err := tool.AES128Encrypt(append([]byte(nil), packet...), []byte("0123456789abcdef"), make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nok.ts\n#EXTINF:10,\nmissing.ts\n#EXT-X-ENDLIST\n")
+		case "/page.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nok.ts\n#EXTINF:10,\npage.ts\n#EXT-X-ENDLIST\n")
+		case "/wrong-key.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n"+
+				"#EXT-X-KEY:METHOD=AES-128,URI=\"k.key\",IV=0x00000000000000000000000000000000\n"+
+				"#EXTINF:10,\nenc.ts\n#EXT-X-ENDLIST\n")
+		case "/k.key":
+			fmt.Fprint(w, "fedcba9876543210")
+		case "/enc.ts":
+			w.Write(encrypted)
+		case "/page.ts":
+			fmt.Fprint(w, "<html><body>rate limited</body></html>")
+		case "/ok.ts":
+			w.Write(packet)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	/*分片失败时StartContext返回的错误按其原因分类*/
+	cases := []struct {
+		playlist string
+		code     int
+	}{
+		{"/missing.m3u8", exitNetwork},
+		{"/wrong-key.m3u8", exitDecrypt},
+		{"/page.m3u8", exitIncomplete},
+	}
+	for _, c := range cases {
+		d, err := dl.NewTask(t.TempDir(), srv.URL+c.playlist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.StartContext(context.Background(), 2, true, 1)
+		if code := exitCode(err); code != c.code {
+			t.Fatalf("%s: expected exit code %d, result: %d (%v)", c.playlist, c.code, code, err)
+		}
+	}
+}
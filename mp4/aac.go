@@ -0,0 +1,89 @@
+package mp4
+
+import (
+	"fmt"
+)
+
+// samples per AAC frame
+const aacFrameSamples = 1024
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+/*ADTS帧头*/
+type adtsHeader struct {
+	objectType   uint8 // profile + 1
+	rateIndex    uint8
+	channels     uint8
+	headerLength int
+	frameLength  int
+}
+
+func parseADTSHeader(b []byte) (*adtsHeader, error) {
+	if len(b) < 7 || b[0] != 0xff || b[1]&0xf0 != 0xf0 {
+		return nil, fmt.Errorf("invalid ADTS sync word")
+	}
+	h := &adtsHeader{
+		objectType:   b[2]>>6 + 1,
+		rateIndex:    b[2] >> 2 & 0x0f,
+		channels:     b[2]&0x01<<2 | b[3]>>6,
+		headerLength: 7,
+		frameLength:  int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5,
+	}
+	/*protection_absent为0时带有CRC*/
+	if b[1]&0x01 == 0 {
+		h.headerLength = 9
+	}
+	if int(h.rateIndex) >= len(aacSampleRates) {
+		return nil, fmt.Errorf("invalid ADTS sampling frequency index: %d", h.rateIndex)
+	}
+	if h.frameLength < h.headerLength {
+		return nil, fmt.Errorf("invalid ADTS frame length: %d", h.frameLength)
+	}
+	return h, nil
+}
+
+func (h *adtsHeader) sampleRate() int {
+	return aacSampleRates[h.rateIndex]
+}
+
+/*拆分PES中的ADTS帧，返回帧头及去掉帧头的raw数据*/
+func splitADTSFrames(b []byte) ([]*adtsHeader, [][]byte) {
+	var headers []*adtsHeader
+	var frames [][]byte
+	for len(b) >= 7 {
+		h, err := parseADTSHeader(b)
+		if err != nil || h.frameLength > len(b) {
+			break
+		}
+		headers = append(headers, h)
+		frames = append(frames, b[h.headerLength:h.frameLength])
+		b = b[h.frameLength:]
+	}
+	return headers, frames
+}
+
+/*生成esds box，包含AudioSpecificConfig*/
+func esds(h *adtsHeader) []byte {
+	asc := []byte{
+		h.objectType<<3 | h.rateIndex>>1,
+		h.rateIndex<<7 | h.channels<<3,
+	}
+	descriptor := func(tag uint8, payload []byte) []byte {
+		return concat(u8(tag), u8(uint8(len(payload))), payload)
+	}
+	decoderConfig := descriptor(0x04, concat(
+		u8(0x40), // objectTypeIndication: MPEG-4 audio
+		u8(0x15), // streamType: audio
+		zeros(3), // bufferSizeDB
+		u32(0),   // maxBitrate
+		u32(0),   // avgBitrate
+		descriptor(0x05, asc),
+	))
+	es := descriptor(0x03, concat(
+		u16(0), // ES_ID
+		u8(0),  // flags
+		decoderConfig,
+		descriptor(0x06, u8(0x02)), // SLConfigDescriptor
+	))
+	return fullBox("esds", 0, 0, es)
+}
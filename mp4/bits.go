@@ -0,0 +1,115 @@
+package mp4
+
+import (
+	"errors"
+)
+
+var errBitsExhausted = errors.New("bit stream exhausted")
+
+// bitReader reads RBSP bits of a NAL unit, including Exp-Golomb codes
+type bitReader struct {
+	b   []byte
+	pos int // bit position
+	err error
+}
+
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = errBitsExhausted
+			return 0
+		}
+		bit := r.b[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.b)*8 {
+		r.err = errBitsExhausted
+	}
+}
+
+/*ue(v)*/
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errBitsExhausted
+			return 0
+		}
+		zeros++
+	}
+	return (1<<uint(zeros) - 1) + r.u(zeros)
+}
+
+/*se(v)*/
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+/*去除NAL中的emulation prevention byte(0x000003)*/
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v == 0x03 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+/*按Annex B起始码(0x000001/0x00000001)拆分NAL unit*/
+func splitNALUnits(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			if start >= 0 {
+				nalus = append(nalus, trimZeros(b[start:i]))
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	var out [][]byte
+	for _, n := range nalus {
+		if len(n) > 0 {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+/*去掉4字节起始码遗留的尾部0*/
+func trimZeros(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,73 @@
+// Package mp4 remuxes MPEG transport streams into ISO base media (MP4) files
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// unity matrix of mvhd and tkhd
+var matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+/*生成box: size + type + payload*/
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+/*生成full box: 在payload前加上version和flags*/
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	vf := u32(uint32(version)<<24 | flags&0x00ffffff)
+	return box(typ, append([][]byte{vf}, payload...)...)
+}
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+/*依次拼接多个字段*/
+func concat(fields ...[]byte) []byte {
+	var b []byte
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return b
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+func matrixBytes() []byte {
+	var b []byte
+	for _, v := range matrix {
+		b = append(b, u32(v)...)
+	}
+	return b
+}
@@ -0,0 +1,118 @@
+package mp4
+
+import (
+	"fmt"
+)
+
+// H.264 NAL unit types
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+)
+
+/*H.264 profile中带有chroma_format_idc等字段的profile*/
+var h264HighProfiles = map[uint32]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+/*解析H.264 SPS，返回图像宽高*/
+func parseH264SPS(nalu []byte) (int, int, error) {
+	r := &bitReader{b: unescapeRBSP(nalu[1:])}
+	profile := r.u(8)
+	r.skip(16) // constraint_set flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	if h264HighProfiles[profile] {
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		r.ue()        // bit_depth_luma_minus8
+		r.ue()        // bit_depth_chroma_minus8
+		r.skip(1)     // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				/*跳过scaling list*/
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + r.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.u(1)
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	width := int(widthInMbs * 16)
+	height := int((2 - frameMbsOnly) * heightInMapUnits * 16)
+	if r.flag() { // frame_cropping_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropX, cropY := uint32(1), 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX, cropY = 2, 2-frameMbsOnly
+		}
+		width -= int(cropX * (left + right))
+		height -= int(cropY * (top + bottom))
+	}
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("parse H.264 SPS: %s", r.err.Error())
+	}
+	return width, height, nil
+}
+
+/*生成avcC box*/
+func avcC(sps []byte, pps []byte) []byte {
+	return box("avcC", concat(
+		u8(1),      // configurationVersion
+		u8(sps[1]), // AVCProfileIndication
+		u8(sps[2]), // profile_compatibility
+		u8(sps[3]), // AVCLevelIndication
+		u8(0xff),   // lengthSizeMinusOne = 3
+		u8(0xe1),   // numOfSequenceParameterSets = 1
+		u16(uint16(len(sps))), sps,
+		u8(1), // numOfPictureParameterSets
+		u16(uint16(len(pps))), pps,
+	))
+}
@@ -0,0 +1,120 @@
+package mp4
+
+import (
+	"fmt"
+)
+
+// H.265 NAL unit types
+const (
+	h265NALBLAW  = 16 // first IRAP type
+	h265NALCRA   = 21 // last IRAP type used by coded pictures
+	h265NALVPS   = 32
+	h265NALSPS   = 33
+	h265NALPPS   = 34
+	h265NALAUD   = 35
+	h265PTLBytes = 12 // general profile_tier_level
+)
+
+/*H.265 SPS中编码hvcC需要的字段*/
+type h265SPS struct {
+	width           int
+	height          int
+	maxSubLayers    uint8
+	temporalNesting uint8
+	ptl             []byte // general profile_tier_level
+	chromaFormat    uint8
+	bitDepthLuma    uint8 // minus 8
+	bitDepthChroma  uint8 // minus 8
+}
+
+func h265NALType(nalu []byte) uint8 {
+	return nalu[0] >> 1 & 0x3f
+}
+
+/*解析H.265 SPS*/
+func parseH265SPS(nalu []byte) (*h265SPS, error) {
+	rbsp := unescapeRBSP(nalu[2:])
+	r := &bitReader{b: rbsp}
+	sps := &h265SPS{}
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := r.u(3)
+	sps.maxSubLayers = uint8(maxSubLayersMinus1 + 1)
+	sps.temporalNesting = uint8(r.u(1))
+	if len(rbsp) < 1+h265PTLBytes {
+		return nil, fmt.Errorf("parse H.265 SPS: too short")
+	}
+	sps.ptl = rbsp[1 : 1+h265PTLBytes]
+	r.skip(h265PTLBytes * 8)
+
+	/*跳过sub layer的profile_tier_level*/
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := range profilePresent {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skip(int(8-maxSubLayersMinus1) * 2)
+	}
+	for i := range profilePresent {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := r.ue()
+	sps.chromaFormat = uint8(chromaFormat)
+	if chromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	sps.width = int(r.ue())
+	sps.height = int(r.ue())
+	if r.flag() { // conformance_window_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		subW, subH := uint32(1), uint32(1)
+		switch chromaFormat {
+		case 1:
+			subW, subH = 2, 2
+		case 2:
+			subW = 2
+		}
+		sps.width -= int(subW * (left + right))
+		sps.height -= int(subH * (top + bottom))
+	}
+	sps.bitDepthLuma = uint8(r.ue())
+	sps.bitDepthChroma = uint8(r.ue())
+	if r.err != nil {
+		return nil, fmt.Errorf("parse H.265 SPS: %s", r.err.Error())
+	}
+	return sps, nil
+}
+
+/*生成hvcC box*/
+func hvcC(sps *h265SPS, vps []byte, spsNALU []byte, pps []byte) []byte {
+	array := func(nalType uint8, nalu []byte) []byte {
+		return concat(
+			u8(0x80|nalType), // array_completeness = 1
+			u16(1),           // numNalus
+			u16(uint16(len(nalu))), nalu,
+		)
+	}
+	return box("hvcC", concat(
+		u8(1),                       // configurationVersion
+		sps.ptl,                     // profile_space, tier, profile_idc, compatibility, constraint and level
+		u16(0xf000),                 // min_spatial_segmentation_idc
+		u8(0xfc),                    // parallelismType
+		u8(0xfc|sps.chromaFormat&3), // chromaFormat
+		u8(0xf8|sps.bitDepthLuma&7),
+		u8(0xf8|sps.bitDepthChroma&7),
+		u16(0), // avgFrameRate
+		u8(sps.maxSubLayers&7<<3|sps.temporalNesting&1<<2|3), // lengthSizeMinusOne = 3
+		u8(3), // numOfArrays
+		array(h265NALVPS, vps),
+		array(h265NALSPS, spsNALU),
+		array(h265NALPPS, pps),
+	))
+}
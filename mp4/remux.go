@@ -0,0 +1,322 @@
+package mp4
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/anlaneg/m3u8/ts"
+)
+
+type remuxer struct {
+	w      *bufio.Writer
+	offset int64 // file offset of the next byte written to w
+
+	video    *track
+	audio    *track
+	videoPID int
+	audioPID int
+
+	/*视频参数集*/
+	hevc bool
+	vps  []byte
+	sps  []byte
+	pps  []byte
+}
+
+// Remux reads the transport stream r and writes a progressive MP4 to w.
+// The first H.264/H.265 stream and the first AAC (ADTS) stream are kept.
+func Remux(r io.Reader, w io.WriteSeeker) error {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	m := &remuxer{
+		w:        bufio.NewWriterSize(w, 1<<20),
+		offset:   start,
+		videoPID: -1,
+		audioPID: -1,
+	}
+
+	ftyp := box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2avc1mp41"))
+	m.write(ftyp)
+	/*mdat使用64位largesize，大小待写完sample后回填*/
+	mdatStart := m.offset
+	m.write(concat(u32(1), []byte("mdat"), u64(0)))
+
+	demuxer := ts.NewDemuxer(r)
+	for {
+		pes, err := demuxer.ReadPES()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.handle(pes); err != nil {
+			return err
+		}
+	}
+	if m.video == nil && m.audio == nil {
+		return fmt.Errorf("no H.264, H.265 or AAC stream found")
+	}
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+
+	/*回填mdat大小*/
+	end := m.offset
+	if _, err := w.Seek(mdatStart+8, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(u64(uint64(end - mdatStart))); err != nil {
+		return err
+	}
+	if _, err := w.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = w.Write(m.moov())
+	return err
+}
+
+func (m *remuxer) write(b []byte) {
+	n, _ := m.w.Write(b)
+	m.offset += int64(n)
+}
+
+func (m *remuxer) handle(pes *ts.PES) error {
+	switch pes.StreamType {
+	case ts.StreamTypeH264, ts.StreamTypeH265:
+		if m.videoPID < 0 {
+			m.videoPID = int(pes.PID)
+			m.hevc = pes.StreamType == ts.StreamTypeH265
+		}
+		if int(pes.PID) == m.videoPID {
+			return m.handleVideo(pes)
+		}
+	case ts.StreamTypeAAC:
+		if m.audioPID < 0 {
+			m.audioPID = int(pes.PID)
+		}
+		if int(pes.PID) == m.audioPID {
+			return m.handleAudio(pes)
+		}
+	}
+	return nil
+}
+
+/*处理一个视频access unit*/
+func (m *remuxer) handleVideo(pes *ts.PES) error {
+	if !pes.HasPTS {
+		return nil
+	}
+	var data []byte
+	keyframe := false
+	for _, nalu := range splitNALUnits(pes.Data) {
+		if m.hevc {
+			if len(nalu) < 2 {
+				continue
+			}
+			switch t := h265NALType(nalu); {
+			case t == h265NALVPS:
+				m.vps = append([]byte(nil), nalu...)
+				continue
+			case t == h265NALSPS:
+				m.sps = append([]byte(nil), nalu...)
+				continue
+			case t == h265NALPPS:
+				m.pps = append([]byte(nil), nalu...)
+				continue
+			case t == h265NALAUD:
+				continue
+			case t >= h265NALBLAW && t <= h265NALCRA:
+				keyframe = true
+			}
+		} else {
+			switch nalu[0] & 0x1f {
+			case h264NALSPS:
+				m.sps = append([]byte(nil), nalu...)
+				continue
+			case h264NALPPS:
+				m.pps = append([]byte(nil), nalu...)
+				continue
+			case h264NALAUD:
+				continue
+			case h264NALIDR:
+				keyframe = true
+			}
+		}
+		/*Annex B转换为4字节长度前缀*/
+		data = append(data, u32(uint32(len(nalu)))...)
+		data = append(data, nalu...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	/*从带有参数集的首个关键帧开始*/
+	if m.video == nil {
+		if !keyframe {
+			return nil
+		}
+		t, err := m.newVideoTrack()
+		if err != nil || t == nil {
+			return err
+		}
+		m.video = t
+		m.video.firstPTS = pes.PTS
+	}
+
+	t := m.video
+	dts := t.unwrapTimestamp(pes.DTS)
+	if len(t.samples) == 0 {
+		t.unwrap = -pes.DTS
+		dts = 0
+	}
+	s := sample{
+		offset: m.offset,
+		size:   uint32(len(data)),
+		dts:    dts,
+		cts:    pes.PTS - pes.DTS,
+		sync:   keyframe,
+	}
+	if s.cts < -timestampWrap/2 {
+		s.cts += timestampWrap
+	}
+	t.add(s, videoTimescale/25)
+	m.write(data)
+	return nil
+}
+
+/*参数集齐备时创建视频track*/
+func (m *remuxer) newVideoTrack() (*track, error) {
+	t := &track{id: m.nextTrackID(), video: true, timescale: videoTimescale}
+	if m.hevc {
+		if m.vps == nil || m.sps == nil || m.pps == nil {
+			return nil, nil
+		}
+		sps, err := parseH265SPS(m.sps)
+		if err != nil {
+			return nil, err
+		}
+		t.width, t.height = sps.width, sps.height
+		t.sampleEntry = videoSampleEntry("hvc1", t.width, t.height, hvcC(sps, m.vps, m.sps, m.pps))
+		return t, nil
+	}
+	if m.sps == nil || m.pps == nil {
+		return nil, nil
+	}
+	width, height, err := parseH264SPS(m.sps)
+	if err != nil {
+		return nil, err
+	}
+	t.width, t.height = width, height
+	t.sampleEntry = videoSampleEntry("avc1", width, height, avcC(m.sps, m.pps))
+	return t, nil
+}
+
+/*处理一个音频PES，其中可能包含多个ADTS帧*/
+func (m *remuxer) handleAudio(pes *ts.PES) error {
+	if !pes.HasPTS {
+		return nil
+	}
+	headers, frames := splitADTSFrames(pes.Data)
+	if len(frames) == 0 {
+		return nil
+	}
+	if m.audio == nil {
+		h := headers[0]
+		m.audio = &track{
+			id:          m.nextTrackID(),
+			timescale:   uint32(h.sampleRate()),
+			sampleEntry: audioSampleEntry(h),
+			firstPTS:    pes.PTS,
+		}
+	}
+
+	t := m.audio
+	pts := t.unwrapTimestamp(pes.PTS)
+	if len(t.samples) == 0 {
+		t.unwrap = -pes.PTS
+		pts = 0
+	}
+	/*转换为采样率时间，与上一帧相差不到半帧时按帧长接续，避免取整抖动*/
+	dts := pts*int64(t.timescale)/videoTimescale + t.shift
+	if n := len(t.samples); n > 0 {
+		expected := t.samples[n-1].dts + aacFrameSamples
+		if diff := dts - expected; diff > -aacFrameSamples/2 && diff < aacFrameSamples/2 {
+			dts = expected
+		}
+	}
+	dts -= t.shift
+	for i, frame := range frames {
+		t.add(sample{
+			offset: m.offset,
+			size:   uint32(len(frame)),
+			dts:    dts + int64(i)*aacFrameSamples,
+			sync:   true,
+		}, aacFrameSamples)
+		m.write(frame)
+	}
+	return nil
+}
+
+func (m *remuxer) nextTrackID() uint32 {
+	id := uint32(1)
+	if m.video != nil {
+		id++
+	}
+	if m.audio != nil {
+		id++
+	}
+	return id
+}
+
+/*生成moov box*/
+func (m *remuxer) moov() []byte {
+	var tracks []*track
+	for _, t := range []*track{m.video, m.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+
+	/*以最早显示的track为影片起点*/
+	start := int64(-1)
+	for _, t := range tracks {
+		if start < 0 || t.firstPTS < start {
+			start = t.firstPTS
+		}
+	}
+
+	var traks [][]byte
+	duration := int64(0)
+	nextID := uint32(1)
+	for _, t := range tracks {
+		delay := (t.firstPTS - start) * movieTimescale / videoTimescale
+		if delay < 0 || delay > maxSampleGap*movieTimescale/videoTimescale {
+			delay = 0
+		}
+		trak := t.trak(delay)
+		traks = append(traks, trak)
+		if d := t.presentedDuration() + delay; d > duration {
+			duration = d
+		}
+		if t.id >= nextID {
+			nextID = t.id + 1
+		}
+	}
+
+	mvhd := fullBox("mvhd", 0, 0, concat(
+		u32(0), u32(0), // creation_time, modification_time
+		u32(movieTimescale),
+		u32(uint32(duration)),
+		u32(0x00010000), // rate 1.0
+		u16(0x0100),     // volume 1.0
+		zeros(10),
+		matrixBytes(),
+		zeros(24),
+		u32(nextID),
+	))
+	return box("moov", append([][]byte{mvhd}, traks...)...)
+}
@@ -0,0 +1,399 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bitWriter builds RBSP test data
+type bitWriter struct {
+	b    []byte
+	bits int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.bits%8))
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// h264SPS returns a baseline SPS NAL unit of width x height (multiples of 16)
+func h264SPS(width, height int) []byte {
+	w := &bitWriter{}
+	w.u(8, 0x67)
+	w.u(8, 66) // profile_idc
+	w.u(8, 0)
+	w.u(8, 30) // level_idc
+	w.ue(0)    // seq_parameter_set_id
+	w.ue(0)    // log2_max_frame_num_minus4
+	w.ue(2)    // pic_order_cnt_type
+	w.ue(1)    // max_num_ref_frames
+	w.u(1, 0)
+	w.ue(uint32(width/16 - 1))
+	w.ue(uint32(height/16 - 1))
+	w.u(1, 1) // frame_mbs_only_flag
+	w.u(1, 1) // direct_8x8_inference_flag
+	w.u(1, 0) // frame_cropping_flag
+	w.u(1, 0) // vui_parameters_present_flag
+	w.u(1, 1) // rbsp_stop_one_bit
+	return w.b
+}
+
+// tsWriter packs PES packets into 188 bytes transport stream packets
+type tsWriter struct {
+	buf bytes.Buffer
+	cc  map[uint16]uint8
+}
+
+func (w *tsWriter) packets(pid uint16, payload []byte) {
+	if w.cc == nil {
+		w.cc = make(map[uint16]uint8)
+	}
+	first := true
+	for len(payload) > 0 {
+		p := make([]byte, 188)
+		p[0] = 0x47
+		p[1] = byte(pid >> 8 & 0x1f)
+		if first {
+			p[1] |= 0x40
+		}
+		p[2] = byte(pid)
+		p[3] = 0x10 | w.cc[pid]&0x0f
+		w.cc[pid]++
+		n := len(payload)
+		if n < 184 {
+			/*用adaptation field填充*/
+			p[3] |= 0x20
+			p[4] = byte(183 - n)
+			if n < 183 {
+				p[5] = 0
+				for i := 6; i < 188-n; i++ {
+					p[i] = 0xff
+				}
+			}
+		} else {
+			n = 184
+		}
+		copy(p[188-n:], payload[:n])
+		payload = payload[n:]
+		first = false
+		w.buf.Write(p)
+	}
+}
+
+func psi(tableID byte, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(length>>8), byte(length), 0, 1, 0xc1, 0, 0}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0) // CRC32 is not checked
+}
+
+func timestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29&0x0e) | 1,
+		byte(ts >> 22), byte(ts>>14) | 1,
+		byte(ts >> 7), byte(ts<<1) | 1,
+	}
+}
+
+func pes(streamID byte, pts, dts int64, data []byte) []byte {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0xc0, 10}
+	header = append(header, timestamp(3, pts)...)
+	header = append(header, timestamp(1, dts)...)
+	if streamID != 0xe0 {
+		length := 3 + 10 + len(data)
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	return append(header, data...)
+}
+
+func adtsFrame(payload int) []byte {
+	length := 7 + payload
+	h := []byte{0xff, 0xf1, 1<<6 | 3<<2, 2 << 6, 0, 0, 0xfc}
+	h[3] |= byte(length >> 11 & 0x03)
+	h[4] = byte(length >> 3)
+	h[5] = byte(length<<5) | 0x1f
+	return append(h, make([]byte, payload)...)
+}
+
+// h265SPSNAL returns an SPS NAL unit of 1920x1088 cropped to 1920x1080
+func h265SPSNAL() []byte {
+	w := &bitWriter{}
+	w.u(4, 0)           // sps_video_parameter_set_id
+	w.u(3, 0)           // sps_max_sub_layers_minus1
+	w.u(1, 1)           // sps_temporal_id_nesting_flag
+	w.u(8, 0x01)        // general_profile_space, tier, profile_idc (Main)
+	w.u(32, 0x60000000) // general_profile_compatibility_flags
+	w.u(16, 0x9000)     // progressive_source_flag, frame_only_constraint_flag
+	w.u(32, 0)
+	w.u(8, 93) // general_level_idc
+	w.ue(0)    // sps_seq_parameter_set_id
+	w.ue(1)    // chroma_format_idc
+	w.ue(1920)
+	w.ue(1088)
+	w.u(1, 1) // conformance_window_flag
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(4)   // bottom offset in chroma samples
+	w.ue(0)   // bit_depth_luma_minus8
+	w.ue(0)   // bit_depth_chroma_minus8
+	w.u(1, 1) // rbsp_stop_one_bit
+	return append([]byte{h265NALSPS << 1, 1}, escapeRBSP(w.b)...)
+}
+
+/*插入emulation prevention字节*/
+func escapeRBSP(b []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+/*解码顺序I P B B，各帧pts-dts依次为1、3、0、0帧*/
+var testCTS = []int64{3600, 10800, 0, 0}
+
+// testStream returns a transport stream of frames 1280x720 H.264 pictures (1920x1080
+// H.265 if hevc) with B-frames and AAC audio
+func testStream(frames int, hevc bool) []byte {
+	w := &tsWriter{}
+	w.packets(0, psi(0x00, []byte{0, 1, 0xe1, 0x00}))
+	videoType := byte(0x1b)
+	if hevc {
+		videoType = 0x24
+	}
+	w.packets(0x100, psi(0x02, []byte{0xe1, 0x01, 0xf0, 0,
+		videoType, 0xe1, 0x01, 0xf0, 0,
+		0x0f, 0xe1, 0x02, 0xf0, 0}))
+	start := int64(900000)
+	for i := 0; i < frames; i++ {
+		var au []byte
+		params := [][]byte{{0x09, 0xf0}, h264SPS(1280, 720), {0x68, 0xce, 0x38, 0x80}}
+		keyframe, picture := []byte{0x65}, []byte{0x41}
+		if hevc {
+			params = [][]byte{{h265NALAUD << 1, 1, 0x50}, {h265NALVPS << 1, 1, 0x0c, 0x01, 0xff, 0xff}, h265SPSNAL(), {h265NALPPS << 1, 1, 0xc1, 0x72}}
+			keyframe, picture = []byte{19 << 1, 1}, []byte{1 << 1, 1}
+		}
+		nal := picture
+		if i%10 == 0 {
+			for _, nalu := range params {
+				au = append(au, append([]byte{0, 0, 0, 1}, nalu...)...)
+			}
+			nal = keyframe
+		}
+		au = append(au, 0, 0, 1)
+		au = append(au, nal...)
+		au = append(au, bytes.Repeat([]byte{byte(i + 1)}, 400)...)
+		dts := start + int64(i)*3600
+		w.packets(0x101, pes(0xe0, dts+testCTS[i%len(testCTS)], dts, au))
+
+		/*每8帧视频(320ms)对应15帧48kHz的AAC*/
+		if i%8 == 0 {
+			var frames []byte
+			for j := 0; j < 15; j++ {
+				frames = append(frames, adtsFrame(100)...)
+			}
+			w.packets(0x102, pes(0xc0, start+int64(i)*3600, start+int64(i)*3600, frames))
+		}
+	}
+	return w.buf.Bytes()
+}
+
+// walk calls f for every box in b, container boxes are entered
+func walk(t *testing.T, b []byte, f func(typ string, payload []byte)) {
+	containers := map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "edts": true, "dinf": true}
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header: %d bytes", len(b))
+		}
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		header := uint64(8)
+		if size == 1 {
+			size = binary.BigEndian.Uint64(b[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			t.Fatalf("invalid size %d of box %s", size, typ)
+		}
+		f(typ, b[header:size])
+		if containers[typ] {
+			walk(t, b[header:size], f)
+		}
+		b = b[size:]
+	}
+}
+
+/*转封装stream，返回文件内容及按类型分组的box*/
+func remuxBoxes(t *testing.T, stream []byte) ([]byte, []string, map[string][][]byte) {
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Remux(bytes.NewReader(stream), f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	boxes := make(map[string][][]byte)
+	walk(t, data, func(typ string, payload []byte) {
+		types = append(types, typ)
+		boxes[typ] = append(boxes[typ], payload)
+	})
+	return data, types, boxes
+}
+
+/*将stts或ctts的游程展开为每个sample的值*/
+func expandEntries(payload []byte) []int64 {
+	var values []int64
+	n := int(binary.BigEndian.Uint32(payload[4:]))
+	for i := 0; i < n; i++ {
+		count := int(binary.BigEndian.Uint32(payload[8+8*i:]))
+		v := int64(binary.BigEndian.Uint32(payload[12+8*i:]))
+		for j := 0; j < count; j++ {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+/*校验每个sample的值均为expected(i)*/
+func checkEntries(t *testing.T, name string, payload []byte, n int, expected func(i int) int64) {
+	values := expandEntries(payload)
+	if len(values) != n {
+		t.Fatalf("%s: expected %d samples, result: %d", name, n, len(values))
+	}
+	for i, v := range values {
+		if v != expected(i) {
+			t.Fatalf("%s: sample %d expected %d, result: %d", name, i, expected(i), v)
+		}
+	}
+}
+
+/*elst中的(segment_duration, media_time)*/
+func editList(payload []byte) [][2]int64 {
+	var edits [][2]int64
+	n := int(binary.BigEndian.Uint32(payload[4:]))
+	for i := 0; i < n; i++ {
+		e := payload[8+12*i:]
+		edits = append(edits, [2]int64{int64(binary.BigEndian.Uint32(e)), int64(int32(binary.BigEndian.Uint32(e[4:])))})
+	}
+	return edits
+}
+
+func TestRemux(t *testing.T) {
+	_, types, boxes := remuxBoxes(t, testStream(50, false))
+	if types[0] != "ftyp" || types[1] != "mdat" || types[2] != "moov" {
+		t.Fatalf("unexpected top level boxes: %v", types[:3])
+	}
+	stsz, tkhd := boxes["stsz"], boxes["tkhd"]
+	if len(stsz) != 2 {
+		t.Fatalf("expected 2 tracks, result: %d", len(stsz))
+	}
+	/*视频50帧，音频7个PES每个15帧*/
+	if n := binary.BigEndian.Uint32(stsz[0][8:]); n != 50 {
+		t.Fatalf("expected 50 video samples, result: %d", n)
+	}
+	if n := binary.BigEndian.Uint32(stsz[1][8:]); n != 7*15 {
+		t.Fatalf("expected %d audio samples, result: %d", 7*15, n)
+	}
+	if size := binary.BigEndian.Uint32(stsz[1][12:]); size != 100 {
+		t.Fatalf("expected raw AAC frames of 100 bytes, result: %d", size)
+	}
+	width := binary.BigEndian.Uint32(tkhd[0][76:]) >> 16
+	height := binary.BigEndian.Uint32(tkhd[0][80:]) >> 16
+	if width != 1280 || height != 720 {
+		t.Fatalf("expected 1280x720, result: %dx%d", width, height)
+	}
+
+	/*视频每帧3600(90kHz)，显示偏移按B帧重排，音频每帧1024个采样*/
+	stts := boxes["stts"]
+	checkEntries(t, "video stts", stts[0], 50, func(int) int64 { return 3600 })
+	checkEntries(t, "audio stts", stts[1], 7*15, func(int) int64 { return 1024 })
+	if len(boxes["ctts"]) != 1 {
+		t.Fatalf("expected ctts in the video track only, result: %d", len(boxes["ctts"]))
+	}
+	checkEntries(t, "video ctts", boxes["ctts"][0], 50, func(i int) int64 { return testCTS[i%len(testCTS)] })
+
+	/*音频从影片起点开始，视频首帧晚一帧(40ms)显示*/
+	elst := boxes["elst"]
+	video, audio := editList(elst[0]), editList(elst[1])
+	if len(video) != 2 || video[0] != [2]int64{40, -1} || video[1][1] != testCTS[0] {
+		t.Fatalf("expected video edit list delayed 40ms starting at media time %d, result: %v", testCTS[0], video)
+	}
+	if len(audio) != 1 || audio[0][1] != 0 {
+		t.Fatalf("expected audio edit list starting at media time 0, result: %v", audio)
+	}
+}
+
+func TestRemuxH265(t *testing.T) {
+	data, _, boxes := remuxBoxes(t, testStream(20, true))
+	tkhd := boxes["tkhd"][0]
+	width := binary.BigEndian.Uint32(tkhd[76:]) >> 16
+	height := binary.BigEndian.Uint32(tkhd[80:]) >> 16
+	if width != 1920 || height != 1080 {
+		t.Fatalf("expected 1920x1080 after cropping, result: %dx%d", width, height)
+	}
+	if !bytes.Contains(data, []byte("hvc1")) {
+		t.Fatal("expected hvc1 sample entry")
+	}
+	idx := bytes.Index(data, []byte("hvcC"))
+	if idx < 0 {
+		t.Fatal("expected hvcC box")
+	}
+	hvcc := data[idx+4:]
+	/*configurationVersion，general profile_tier_level取自SPS*/
+	ptl := []byte{0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 93}
+	if hvcc[0] != 1 || !bytes.Equal(hvcc[1:13], ptl) {
+		t.Fatalf("unexpected hvcC header: % x", hvcc[:13])
+	}
+	if n := hvcc[22]; n != 3 {
+		t.Fatalf("expected VPS, SPS and PPS arrays, result: %d", n)
+	}
+	checkEntries(t, "video stts", boxes["stts"][0], 20, func(int) int64 { return 3600 })
+	checkEntries(t, "video ctts", boxes["ctts"][0], 20, func(i int) int64 { return testCTS[i%len(testCTS)] })
+}
+
+func TestParseH264SPS(t *testing.T) {
+	w, h, err := parseH264SPS(h264SPS(1920, 1088))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != 1920 || h != 1088 {
+		t.Fatalf("expected 1920x1088, result: %dx%d", w, h)
+	}
+}
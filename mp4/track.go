@@ -0,0 +1,257 @@
+package mp4
+
+const (
+	movieTimescale = 1000
+	videoTimescale = 90000
+	// timestamps are 33 bits wide in transport streams
+	timestampWrap = int64(1) << 33
+	// a gap larger than this between two samples is treated as a timestamp discontinuity
+	maxSampleGap = 10 * videoTimescale
+)
+
+type sample struct {
+	offset int64
+	size   uint32
+	dts    int64 // track timescale, starts from 0
+	cts    int64 // pts - dts
+	sync   bool
+}
+
+type track struct {
+	id          uint32
+	video       bool
+	timescale   uint32
+	width       int
+	height      int
+	sampleEntry []byte
+	samples     []sample
+
+	firstPTS int64 // 90kHz, first presented timestamp, used for the edit list
+	lastRaw  int64 // last raw 90kHz DTS, used to unwrap timestamps
+	unwrap   int64 // added to raw timestamps: minus the first timestamp, plus wrap arounds
+	shift    int64 // added to timestamps after a discontinuity, track timescale
+	delta    int64 // last sample duration, track timescale
+}
+
+/*处理33位时间戳回绕，返回连续的90kHz时间戳*/
+func (t *track) unwrapTimestamp(raw int64) int64 {
+	if len(t.samples) > 0 {
+		if t.lastRaw-raw > timestampWrap/2 {
+			t.unwrap += timestampWrap
+		} else if raw-t.lastRaw > timestampWrap/2 {
+			t.unwrap -= timestampWrap
+		}
+	}
+	t.lastRaw = raw
+	return raw + t.unwrap
+}
+
+/*加入一个sample，dts为track timescale下相对首个sample的时间，遇到时间戳跳变时接续上一个sample*/
+func (t *track) add(s sample, defaultDelta int64) {
+	s.dts += t.shift
+	if n := len(t.samples); n > 0 {
+		prev := t.samples[n-1].dts
+		gap := s.dts - prev
+		if gap <= 0 || gap > maxSampleGap*int64(t.timescale)/videoTimescale {
+			delta := t.delta
+			if delta <= 0 {
+				delta = defaultDelta
+			}
+			t.shift += prev + delta - s.dts
+			s.dts = prev + delta
+		}
+		t.delta = s.dts - prev
+	}
+	t.samples = append(t.samples, s)
+}
+
+/*track的媒体时长，track timescale*/
+func (t *track) duration() int64 {
+	n := len(t.samples)
+	if n == 0 {
+		return 0
+	}
+	return t.samples[n-1].dts + t.lastDelta()
+}
+
+/*track显示时长，movie timescale*/
+func (t *track) presentedDuration() int64 {
+	return t.duration() * movieTimescale / int64(t.timescale)
+}
+
+func (t *track) lastDelta() int64 {
+	if t.delta > 0 {
+		return t.delta
+	}
+	if t.video {
+		return videoTimescale / 25
+	}
+	return aacFrameSamples
+}
+
+/*生成trak box，delay为track相对影片开始的延迟(movie timescale)*/
+func (t *track) trak(delay int64) []byte {
+	mediaTime := int64(0)
+	if len(t.samples) > 0 {
+		mediaTime = t.samples[0].cts
+	}
+	duration := t.duration()
+	presented := t.presentedDuration() + delay
+
+	volume, handler, name := uint16(0), "vide", "VideoHandler"
+	header := fullBox("vmhd", 0, 1, u16(0), zeros(6))
+	if !t.video {
+		volume, handler, name = 0x0100, "soun", "SoundHandler"
+		header = fullBox("smhd", 0, 0, u16(0), u16(0))
+	}
+
+	tkhd := fullBox("tkhd", 0, 3, concat(
+		u32(0), u32(0), // creation_time, modification_time
+		u32(t.id),
+		u32(0), // reserved
+		u32(uint32(presented)),
+		zeros(8),
+		u16(0), u16(0), // layer, alternate_group
+		u16(volume),
+		u16(0),
+		matrixBytes(),
+		u32(uint32(t.width)<<16),
+		u32(uint32(t.height)<<16),
+	))
+
+	/*edit list: 先是延迟的空白，再从首个sample的显示时间开始*/
+	var edits [][]byte
+	if delay > 0 {
+		edits = append(edits, concat(u32(uint32(delay)), u32(0xffffffff), u16(1), u16(0)))
+	}
+	edits = append(edits, concat(u32(uint32(presented-delay)), u32(uint32(mediaTime)), u16(1), u16(0)))
+	elst := fullBox("elst", 0, 0, u32(uint32(len(edits))), concat(edits...))
+
+	mdhd := fullBox("mdhd", 1, 0, concat(
+		u64(0), u64(0),
+		u32(t.timescale),
+		u64(uint64(duration)),
+		u16(0x55c4), // und
+		u16(0),
+	))
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), zeros(12), []byte(name), u8(0))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	minf := box("minf", header, dinf, t.stbl())
+
+	return box("trak", tkhd, box("edts", elst), box("mdia", mdhd, hdlr, minf))
+}
+
+/*生成sample table*/
+func (t *track) stbl() []byte {
+	n := len(t.samples)
+	stsd := fullBox("stsd", 0, 0, u32(1), t.sampleEntry)
+
+	/*stts: 按相同时长游程编码*/
+	var stts []byte
+	entries := 0
+	for i := 0; i < n; {
+		delta := t.sampleDelta(i)
+		j := i + 1
+		for j < n && t.sampleDelta(j) == delta {
+			j++
+		}
+		stts = append(stts, concat(u32(uint32(j-i)), u32(uint32(delta)))...)
+		entries++
+		i = j
+	}
+	boxes := [][]byte{stsd, fullBox("stts", 0, 0, u32(uint32(entries)), stts)}
+
+	/*ctts: 仅在存在B帧等显示时间与解码时间不同时*/
+	hasCTS := false
+	for _, s := range t.samples {
+		if s.cts != 0 {
+			hasCTS = true
+			break
+		}
+	}
+	if hasCTS {
+		var ctts []byte
+		entries = 0
+		for i := 0; i < n; {
+			j := i + 1
+			for j < n && t.samples[j].cts == t.samples[i].cts {
+				j++
+			}
+			cts := t.samples[i].cts
+			if cts < 0 {
+				cts = 0
+			}
+			ctts = append(ctts, concat(u32(uint32(j-i)), u32(uint32(cts)))...)
+			entries++
+			i = j
+		}
+		boxes = append(boxes, fullBox("ctts", 0, 0, u32(uint32(entries)), ctts))
+	}
+
+	/*stss: 关键帧列表，全为关键帧时省略*/
+	if t.video {
+		var stss []byte
+		count := 0
+		for i, s := range t.samples {
+			if s.sync {
+				stss = append(stss, u32(uint32(i+1))...)
+				count++
+			}
+		}
+		if count != n {
+			boxes = append(boxes, fullBox("stss", 0, 0, u32(uint32(count)), stss))
+		}
+	}
+
+	/*每个chunk一个sample*/
+	stsc := fullBox("stsc", 0, 0, u32(1), u32(1), u32(1), u32(1))
+	sizes := make([]byte, 0, 4*n)
+	offsets := make([]byte, 0, 8*n)
+	for _, s := range t.samples {
+		sizes = append(sizes, u32(s.size)...)
+		offsets = append(offsets, u64(uint64(s.offset))...)
+	}
+	stsz := fullBox("stsz", 0, 0, u32(0), u32(uint32(n)), sizes)
+	co64 := fullBox("co64", 0, 0, u32(uint32(n)), offsets)
+	boxes = append(boxes, stsc, stsz, co64)
+	return box("stbl", boxes...)
+}
+
+/*第i个sample的时长*/
+func (t *track) sampleDelta(i int) int64 {
+	if i+1 < len(t.samples) {
+		return t.samples[i+1].dts - t.samples[i].dts
+	}
+	return t.lastDelta()
+}
+
+/*视频sample entry: avc1或hvc1*/
+func videoSampleEntry(typ string, width int, height int, config []byte) []byte {
+	return box(typ, concat(
+		zeros(6), u16(1), // reserved, data_reference_index
+		zeros(16), // pre_defined, reserved
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), // 72 dpi
+		u32(0),
+		u16(1),      // frame_count
+		zeros(32),   // compressorname
+		u16(0x0018), // depth
+		u16(0xffff), // pre_defined = -1
+	), config)
+}
+
+/*音频sample entry: mp4a*/
+func audioSampleEntry(h *adtsHeader) []byte {
+	channels := uint16(h.channels)
+	if channels == 0 {
+		channels = 2
+	}
+	return box("mp4a", concat(
+		zeros(6), u16(1), // reserved, data_reference_index
+		zeros(8),
+		u16(channels),
+		u16(16), // samplesize
+		u16(0), u16(0),
+		u32(uint32(h.sampleRate())<<16),
+	), esds(h))
+}
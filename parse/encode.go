@@ -0,0 +1,102 @@
+package parse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Encode writes m to w as HLS playlist text, the result can be read back by FromURL
+func (m *M3u8) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	if m.Version > 0 {
+		fmt.Fprintf(bw, "#EXT-X-VERSION:%d\n", m.Version)
+	}
+
+	/*master playlist只包含variant*/
+	for _, mp := range m.MasterPlaylist {
+		fmt.Fprintf(bw, "#EXT-X-STREAM-INF:%s\n%s\n", encodeMasterPlaylist(mp), mp.URI)
+	}
+
+	if m.PlaylistType != "" {
+		fmt.Fprintf(bw, "#EXT-X-PLAYLIST-TYPE:%s\n", m.PlaylistType)
+	}
+	if m.TargetDuration > 0 {
+		/*RFC 8216要求为整数，向上取整*/
+		fmt.Fprintf(bw, "#EXT-X-TARGETDURATION:%d\n", int64(math.Ceil(m.TargetDuration)))
+	}
+	if m.MediaSequence > 0 {
+		fmt.Fprintf(bw, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.MediaSequence)
+	}
+
+	keyIndex := 0
+	for _, seg := range m.Segments {
+		/*key变化时输出新的EXT-X-KEY，作用于其后所有分片*/
+		if seg.KeyIndex != keyIndex {
+			fmt.Fprintf(bw, "#EXT-X-KEY:%s\n", encodeKey(m.Keys[seg.KeyIndex]))
+			keyIndex = seg.KeyIndex
+		}
+		if seg.Discontinuity {
+			fmt.Fprintln(bw, "#EXT-X-DISCONTINUITY")
+		}
+		fmt.Fprintf(bw, "#EXTINF:%s,%s\n", strconv.FormatFloat(float64(seg.Duration), 'f', -1, 32), seg.Title)
+		if seg.Length > 0 {
+			fmt.Fprintf(bw, "#EXT-X-BYTERANGE:%d@%d\n", seg.Length, seg.Offset)
+		}
+		fmt.Fprintln(bw, seg.URI)
+	}
+
+	if m.EndList {
+		fmt.Fprintln(bw, "#EXT-X-ENDLIST")
+	}
+	return bw.Flush()
+}
+
+// String returns m as HLS playlist text
+func (m *M3u8) String() string {
+	var buf bytes.Buffer
+	_ = m.Encode(&buf)
+	return buf.String()
+}
+
+/*生成EXT-X-STREAM-INF的参数*/
+func encodeMasterPlaylist(mp *MasterPlaylist) string {
+	var attrs []string
+	if mp.ProgramID > 0 {
+		attrs = append(attrs, fmt.Sprintf("PROGRAM-ID=%d", mp.ProgramID))
+	}
+	attrs = append(attrs, fmt.Sprintf("BANDWIDTH=%d", mp.BandWidth))
+	if mp.Resolution != "" {
+		attrs = append(attrs, "RESOLUTION="+mp.Resolution)
+	}
+	if mp.Codecs != "" {
+		attrs = append(attrs, `CODECS="`+mp.Codecs+`"`)
+	}
+	return strings.Join(attrs, ",")
+}
+
+/*生成EXT-X-KEY的参数，nil表示不加密*/
+func encodeKey(key *Key) string {
+	if key == nil || key.Method == "" || key.Method == CryptMethodNONE {
+		return "METHOD=" + string(CryptMethodNONE)
+	}
+	attrs := []string{"METHOD=" + string(key.Method)}
+	if key.URI != "" {
+		attrs = append(attrs, `URI="`+key.URI+`"`)
+	}
+	if key.IV != "" {
+		attrs = append(attrs, "IV="+key.IV)
+	}
+	if key.KeyFormat != "" {
+		attrs = append(attrs, `KEYFORMAT="`+key.KeyFormat+`"`)
+	}
+	if key.KeyFormatVersions != "" {
+		attrs = append(attrs, `KEYFORMATVERSIONS="`+key.KeyFormatVersions+`"`)
+	}
+	return strings.Join(attrs, ",")
+}
@@ -0,0 +1,104 @@
+package parse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	playlists := []string{
+		`#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:3
+#EXTINF:9.009,Live from Paris, part 1
+0.ts
+#EXT-X-KEY:METHOD=AES-128,URI="https://example.com/k1.key",IV=0x00000000000000000000000000000001
+#EXTINF:10,
+#EXT-X-BYTERANGE:1000@0
+1.ts
+#EXTINF:4.5,
+#EXT-X-BYTERANGE:2000@1000
+1.ts
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-DISCONTINUITY
+#EXTINF:10,
+2.ts
+#EXT-X-ENDLIST
+`,
+		masterPlaylist,
+	}
+	for _, playlist := range playlists {
+		m3u8, err := parse(strings.NewReader(playlist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := m3u8.String()
+		again, err := parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m3u8, again) {
+			t.Fatalf("round trip mismatch:\n%s\n---\n%s", playlist, text)
+		}
+		if text != again.String() {
+			t.Fatalf("encode is not stable:\n%s\n---\n%s", text, again.String())
+		}
+	}
+}
+
+func TestEncodeKeyChange(t *testing.T) {
+	m3u8 := &M3u8{
+		TargetDuration: 10,
+		Keys: map[int]*Key{
+			1: {Method: CryptMethodAES, URI: "local.key"},
+		},
+		Segments: []*Segment{
+			{URI: "0.ts", Duration: 10, KeyIndex: 1},
+			{URI: "1.ts", Duration: 10, KeyIndex: 1},
+		},
+		EndList: true,
+	}
+	expected := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=AES-128,URI="local.key"
+#EXTINF:10,
+0.ts
+#EXTINF:10,
+1.ts
+#EXT-X-ENDLIST
+`
+	if result := m3u8.String(); result != expected {
+		t.Fatalf("expected:\n%s\nresult:\n%s", expected, result)
+	}
+}
+
+func TestEncodeTitleAndTargetDuration(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:9.5,Live from Paris, part 1\n0.ts\n#EXTINF:4 ,\n1.ts\n#EXT-X-ENDLIST\n"
+	m3u8, err := parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	/*title为第一个,号之后的全部内容*/
+	if title := m3u8.Segments[0].Title; title != "Live from Paris, part 1" {
+		t.Fatalf("unexpected title %q", title)
+	}
+	if m3u8.Segments[1].Duration != 4 || m3u8.Segments[1].Title != "" {
+		t.Fatalf("unexpected segment %+v", m3u8.Segments[1])
+	}
+	again, err := parse(strings.NewReader(m3u8.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m3u8, again) {
+		t.Fatalf("round trip mismatch:\n%s", m3u8.String())
+	}
+
+	/*EXT-X-TARGETDURATION为向上取整的整数*/
+	m3u8.TargetDuration = 9.2
+	if text := m3u8.String(); !strings.Contains(text, "#EXT-X-TARGETDURATION:10\n") {
+		t.Fatalf("expected integer target duration, result:\n%s", text)
+	}
+}
@@ -0,0 +1,166 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// KeySize is the size of AES-128 and SAMPLE-AES keys
+const KeySize = 16
+
+// KeyProvider supplies decryption keys without requesting the key URI,
+// e.g. when the URI needs authentication or the key is kept elsewhere.
+// It is consulted before the HTTP request, ok false falls back to the next provider.
+type KeyProvider interface {
+	Key(key *Key, keyURL string) (value []byte, ok bool, err error)
+}
+
+// KeyProviders consults each provider in order until one has the key
+type KeyProviders []KeyProvider
+
+// Key implements KeyProvider
+func (p KeyProviders) Key(key *Key, keyURL string) ([]byte, bool, error) {
+	for _, provider := range p {
+		value, ok, err := provider.Key(key, keyURL)
+		if err != nil || ok {
+			return value, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// StaticKeyProvider returns the same key for every EXT-X-KEY, e.g. given as hex with -key
+type StaticKeyProvider []byte
+
+// NewHexKeyProvider returns a StaticKeyProvider of the 32 digits hexadecimal key s
+func NewHexKeyProvider(s string) (StaticKeyProvider, error) {
+	key, err := DecodeKey([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	return StaticKeyProvider(key), nil
+}
+
+// Key implements KeyProvider
+func (p StaticKeyProvider) Key(*Key, string) ([]byte, bool, error) {
+	return p, true, nil
+}
+
+// FileKeyProvider reads the key of every EXT-X-KEY from a local file
+type FileKeyProvider struct {
+	Path string
+}
+
+// Key implements KeyProvider
+func (p *FileKeyProvider) Key(*Key, string) ([]byte, bool, error) {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	key, err := DecodeKey(b)
+	if err != nil {
+		return nil, false, fmt.Errorf("key file %s: %s", p.Path, err.Error())
+	}
+	return key, true, nil
+}
+
+// DefaultKeyCommandTimeout bounds the run of an ExecKeyProvider without Timeout
+const DefaultKeyCommandTimeout = 30 * time.Second
+
+// ExecKeyProvider runs a command with the key URL as last argument and reads the key from its stdout.
+// Command is split on whitespace without quoting, set Args instead for arguments
+// containing spaces. The command is killed after Timeout, DefaultKeyCommandTimeout if 0.
+type ExecKeyProvider struct {
+	Command string
+	// Args is the program and its arguments, used instead of Command when set
+	Args    []string
+	Timeout time.Duration
+}
+
+// Key implements KeyProvider
+func (p *ExecKeyProvider) Key(key *Key, keyURL string) ([]byte, bool, error) {
+	args := p.Args
+	if len(args) == 0 {
+		args = strings.Fields(p.Command)
+	}
+	if len(args) == 0 {
+		return nil, false, fmt.Errorf("empty key command")
+	}
+	name := strings.Join(args, " ")
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultKeyCommandTimeout
+	}
+	/*卡住的命令不能阻塞下载*/
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], keyURL)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, false, fmt.Errorf("key command %s: no key after %s", name, timeout)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("key command %s: %s %s", name, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	value, err := DecodeKey(out)
+	if err != nil {
+		return nil, false, fmt.Errorf("key command %s: %s", name, err.Error())
+	}
+	return value, true, nil
+}
+
+// DataURIKeyProvider decodes keys embedded in the playlist as data: URIs (RFC 2397)
+type DataURIKeyProvider struct{}
+
+// Key implements KeyProvider
+func (DataURIKeyProvider) Key(key *Key, _ string) ([]byte, bool, error) {
+	if !strings.HasPrefix(key.URI, "data:") {
+		return nil, false, nil
+	}
+	idx := strings.Index(key.URI, ",")
+	if idx < 0 {
+		return nil, false, fmt.Errorf("invalid data URI key: missing ','")
+	}
+	meta, data := key.URI[len("data:"):idx], key.URI[idx+1:]
+	var value []byte
+	var err error
+	if strings.HasSuffix(meta, ";base64") {
+		value, err = base64.StdEncoding.DecodeString(data)
+	} else {
+		var s string
+		s, err = url.PathUnescape(data)
+		value = []byte(s)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid data URI key: %s", err.Error())
+	}
+	if len(value) != KeySize {
+		return nil, false, fmt.Errorf("invalid data URI key length %d, expected %d bytes", len(value), KeySize)
+	}
+	return value, true, nil
+}
+
+// DecodeKey accepts 16 raw bytes or 32 hexadecimal digits (optionally 0x prefixed)
+func DecodeKey(b []byte) ([]byte, error) {
+	if len(b) == KeySize {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(s) == 2*KeySize {
+		if key, err := hex.DecodeString(s); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid key of %d bytes, expected %d raw bytes or %d hex digits", len(b), KeySize, 2*KeySize)
+}
@@ -0,0 +1,129 @@
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeyHex = "000102030405060708090a0b0c0d0e0f"
+
+var testKey = []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f")
+
+func TestKeyProviders(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(keyFile, []byte("0x"+testKeyHex+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hexProvider, err := NewHexKeyProvider(testKeyHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]KeyProvider{
+		"hex":  hexProvider,
+		"file": &FileKeyProvider{Path: keyFile},
+	}
+	if runtime.GOOS != "windows" {
+		script := filepath.Join(dir, "key.sh")
+		content := "#!/bin/sh\n[ \"$1\" = \"https://example.com/k\" ] && printf " + testKeyHex + "\n"
+		if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+			t.Fatal(err)
+		}
+		providers["exec"] = &ExecKeyProvider{Command: script}
+	}
+	for name, p := range providers {
+		value, ok, err := p.Key(&Key{URI: "k"}, "https://example.com/k")
+		if err != nil || !ok {
+			t.Fatalf("%s: expected key, result: %v %v", name, ok, err)
+		}
+		if !bytes.Equal(value, testKey) {
+			t.Fatalf("%s: unexpected key %x", name, value)
+		}
+	}
+
+	value, ok, err := DataURIKeyProvider{}.Key(&Key{URI: "data:text/plain;base64,AAECAwQFBgcICQoLDA0ODw=="}, "")
+	if err != nil || !ok || !bytes.Equal(value, testKey) {
+		t.Fatalf("data URI: unexpected key %x %v %v", value, ok, err)
+	}
+	if _, ok, _ := (DataURIKeyProvider{}).Key(&Key{URI: "https://example.com/k"}, ""); ok {
+		t.Fatal("data URI provider should skip other URIs")
+	}
+	if _, err := NewHexKeyProvider("0011"); err == nil {
+		t.Fatal("expected invalid key length error")
+	}
+}
+
+func TestExecKeyProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts")
+	}
+	/*路径包含空格时通过Args传入*/
+	dir := filepath.Join(t.TempDir(), "key helper")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "key.sh")
+	content := "#!/bin/sh\n[ \"$1\" = \"my account\" ] && printf " + testKeyHex + "\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatal(err)
+	}
+	value, ok, err := (&ExecKeyProvider{Args: []string{script, "my account"}}).Key(&Key{URI: "k"}, "https://example.com/k")
+	if err != nil || !ok || !bytes.Equal(value, testKey) {
+		t.Fatalf("unexpected key %x %v %v", value, ok, err)
+	}
+
+	/*卡住的命令超时后被终止*/
+	hang := filepath.Join(dir, "hang.sh")
+	if err := ioutil.WriteFile(hang, []byte("#!/bin/sh\nexec sleep 10\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, _, err = (&ExecKeyProvider{Args: []string{hang}, Timeout: 100 * time.Millisecond}).Key(&Key{URI: "k"}, "https://example.com/k")
+	if err == nil || !strings.Contains(err.Error(), "no key after") {
+		t.Fatalf("expected a timeout error, result: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("key command not killed, took %s", elapsed)
+	}
+}
+
+func TestFetchKeyProvider(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"short.key\"\n#EXTINF:10,\n0.ts\n#EXT-X-ENDLIST\n")
+		case "/short.key":
+			requested = true
+			w.Write([]byte("short"))
+		}
+	}))
+	defer srv.Close()
+
+	/*HTTP返回的key必须为16字节*/
+	if _, err := FromURL(srv.URL + "/index.m3u8"); !errors.Is(err, ErrKeyFetch) || !strings.Contains(err.Error(), "expected 16") {
+		t.Fatalf("expected key length error, result: %v", err)
+	}
+
+	requested = false
+	r, err := FromURLWithOptions(srv.URL+"/index.m3u8", &Options{KeyProvider: StaticKeyProvider(testKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested {
+		t.Fatal("key URI requested although the provider has the key")
+	}
+	if r.Keys[1] != string(testKey) {
+		t.Fatalf("unexpected key %x", r.Keys[1])
+	}
+}
@@ -3,12 +3,16 @@ package parse
 
 import (
 	"bufio"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/anlaneg/m3u8/tool"
 )
 
 type (
@@ -20,8 +24,13 @@ const (
 	PlaylistTypeVOD   PlaylistType = "VOD"
 	PlaylistTypeEvent PlaylistType = "EVENT"
 
-	CryptMethodAES  CryptMethod = "AES-128"
-	CryptMethodNONE CryptMethod = "NONE"
+	CryptMethodAES       CryptMethod = "AES-128"
+	CryptMethodSampleAES CryptMethod = "SAMPLE-AES"
+	CryptMethodNONE      CryptMethod = "NONE"
+
+	// KeyFormatIdentity is the key format of a key file holding the 16 raw key bytes,
+	// other formats are DRM systems (e.g. FairPlay, Widevine) that can not be decrypted
+	KeyFormatIdentity = "identity"
 )
 
 // regex pattern for extracting `key=value` parameters from a line
@@ -45,6 +54,9 @@ type Segment struct {
 	Duration float32 // #EXTINF: duration,<title>
 	Length   uint64  // #EXT-X-BYTERANGE: length[@offset]
 	Offset   uint64  // #EXT-X-BYTERANGE: length[@offset]
+	Sequence uint64  // Media sequence number, #EXT-X-MEDIA-SEQUENCE + index
+	// #EXT-X-DISCONTINUITY before this segment
+	Discontinuity bool
 }
 
 // #EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=240000,RESOLUTION=416x234,CODECS="avc1.42e00a,mp4a.40.2"
@@ -58,11 +70,45 @@ type MasterPlaylist struct {
 
 // #EXT-X-KEY:METHOD=AES-128,URI="key.key"
 type Key struct {
-	// 'AES-128' or 'NONE'
+	// 'AES-128', 'SAMPLE-AES' or 'NONE'
 	// If the encryption method is NONE, the URI and the IV attributes MUST NOT be present
 	Method CryptMethod
 	URI    string
 	IV     string
+	// KEYFORMAT, empty means identity
+	KeyFormat string
+	// KEYFORMATVERSIONS, e.g. "1" or "1/2/5"
+	KeyFormatVersions string
+}
+
+// IVBytes returns the 16 bytes IV used to decrypt the segment with media sequence number sequence.
+// The IV attribute is a hexadecimal 0x... string, when it is absent the sequence number
+// is used as a big-endian 128-bit IV (RFC 8216 section 5.2).
+func (k *Key) IVBytes(sequence uint64) ([]byte, error) {
+	iv := make([]byte, 16)
+	if k.IV == "" {
+		binary.BigEndian.PutUint64(iv[8:], sequence)
+		return iv, nil
+	}
+	s := strings.TrimPrefix(strings.TrimPrefix(k.IV, "0x"), "0X")
+	if len(s) > 32 {
+		return nil, fmt.Errorf("invalid IV %s: longer than 128 bits", k.IV)
+	}
+	/*位数不足时高位补0*/
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IV %s: %s", k.IV, err.Error())
+	}
+	copy(iv[16-len(b):], b)
+	return iv, nil
+}
+
+// IsIdentity reports whether the key is a plain key file that can be fetched and used
+func (k *Key) IsIdentity() bool {
+	return k.KeyFormat == "" || k.KeyFormat == KeyFormatIdentity
 }
 
 func parse(reader io.Reader) (*M3u8, error) {
@@ -86,6 +132,10 @@ func parse(reader io.Reader) (*M3u8, error) {
 		seg     *Segment
 		extInf  bool
 		extByte bool
+		/*byte range是否带有@offset*/
+		extByteOffset bool
+		/*自上一个分片以来是否出现过EXT-X-KEY*/
+		keySinceSeg bool
 	)
 
 	for ; i < count; i++ {
@@ -100,7 +150,7 @@ func parse(reader io.Reader) (*M3u8, error) {
 			if "#EXTM3U" == line {
 				continue
 			}
-			fmt.Println("invalid m3u8, missing #EXTM3U in line 1,ignore.")
+			tool.Log().Warn("invalid m3u8, missing #EXTM3U in line 1, ignored")
 		}
 		switch {
 		case line == "":
@@ -159,21 +209,15 @@ func parse(reader io.Reader) (*M3u8, error) {
 				seg = new(Segment)
 			}
 
-			/*解出参数*/
-			var s string
-			if _, err := fmt.Sscanf(line, "#EXTINF:%s", &s); err != nil {
-				return nil, err
-			}
-
-			/*如果s包含,号，则首先是title*/
-			if strings.Contains(s, ",") {
-				split := strings.Split(s, ",")
-				seg.Title = split[1]
-				s = split[0]
+			/*解出参数: duration，第一个,号之后全部为title，可包含空格与,号*/
+			s := line[len("#EXTINF:"):]
+			if idx := strings.Index(s, ","); idx >= 0 {
+				seg.Title = s[idx+1:]
+				s = s[:idx]
 			}
 
 			/*解析duration*/
-			df, err := strconv.ParseFloat(s, 32)
+			df, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
 			if err != nil {
 				return nil, err
 			}
@@ -210,6 +254,7 @@ func parse(reader io.Reader) (*M3u8, error) {
 				}
 				seg.Offset = uint64(offset)
 				b = split[0]
+				extByteOffset = true
 			}
 
 			/*解析seg对应的length*/
@@ -228,8 +273,21 @@ func parse(reader io.Reader) (*M3u8, error) {
 				}
 				/*记录此seg对应的uri*/
 				seg.URI = line
+				/*记录此seg对应的media sequence*/
+				seg.Sequence = m3u8.MediaSequence + uint64(len(m3u8.Segments))
+				/*byte range未指定offset时，紧接同一资源上一分片的子区间*/
+				if extByte && !extByteOffset {
+					if n := len(m3u8.Segments); n > 0 {
+						prev := m3u8.Segments[n-1]
+						if prev.Length > 0 && prev.URI == seg.URI {
+							seg.Offset = prev.Offset + prev.Length
+						}
+					}
+				}
 				extByte = false
+				extByteOffset = false
 				extInf = false
+				keySinceSeg = false
 
 				/*添加segments*/
 				m3u8.Segments = append(m3u8.Segments, seg)
@@ -246,18 +304,37 @@ func parse(reader io.Reader) (*M3u8, error) {
 
 			/*检查加密方法*/
 			method := CryptMethod(params["METHOD"])
-			if method != "" && method != CryptMethodAES && method != CryptMethodNONE {
+			if method != "" && method != CryptMethodAES && method != CryptMethodSampleAES && method != CryptMethodNONE {
 				return nil, fmt.Errorf("invalid EXT-X-KEY method: %s, line: %d", method, i+1)
 			}
 
+			k := &Key{
+				Method:            method,
+				URI:               params["URI"],
+				IV:                params["IV"],
+				KeyFormat:         params["KEYFORMAT"],
+				KeyFormatVersions: params["KEYFORMATVERSIONS"],
+			}
+			/*同一组分片可同时给出多种KEYFORMAT的key，优先使用identity格式*/
+			if keySinceSeg && key != nil && key.IsIdentity() != k.IsIdentity() {
+				if k.IsIdentity() {
+					*key = *k
+				}
+				continue
+			}
+
 			/*记录key*/
 			keyIndex++
-			key = new(Key)
-			key.Method = method
-			key.URI = params["URI"]
-			key.IV = params["IV"]
+			key = k
+			keySinceSeg = true
 			m3u8.Keys[keyIndex] = key
-		case line == "#EndList":
+		case line == "#EXT-X-DISCONTINUITY":
+			/*作用于下一个分片*/
+			if seg == nil {
+				seg = new(Segment)
+			}
+			seg.Discontinuity = true
+		case line == "#EXT-X-ENDLIST" || line == "#EndList":
 			/*标明list终止*/
 			m3u8.EndList = true
 		default:
@@ -0,0 +1,118 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:7
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:1000@376
+main.ts
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:2000
+main.ts
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:500
+main.ts
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:300
+other.ts
+#EXT-X-ENDLIST
+`
+	m3u8, err := parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		length, offset, sequence uint64
+	}{
+		{1000, 376, 7},
+		{2000, 1376, 8},
+		{500, 3376, 9},
+		{300, 0, 10},
+	}
+	if len(m3u8.Segments) != len(expected) {
+		t.Fatalf("expected %d segments, result: %d", len(expected), len(m3u8.Segments))
+	}
+	for i, e := range expected {
+		seg := m3u8.Segments[i]
+		if seg.Length != e.length || seg.Offset != e.offset || seg.Sequence != e.sequence {
+			t.Fatalf("segment %d: expected %d@%d seq %d, result: %d@%d seq %d",
+				i, e.length, e.offset, e.sequence, seg.Length, seg.Offset, seg.Sequence)
+		}
+	}
+	if !m3u8.EndList {
+		t.Fatal("expected #EXT-X-ENDLIST to be parsed")
+	}
+}
+
+func TestParseKeyFormat(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://key",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key.bin",KEYFORMAT="identity",IV=0x0102
+#EXTINF:10.0,
+0.ts
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://other",KEYFORMAT="com.apple.streamingkeydelivery"
+#EXTINF:10.0,
+1.ts
+#EXT-X-ENDLIST
+`
+	m3u8, err := parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m3u8.Keys) != 2 {
+		t.Fatalf("expected 2 keys, result: %d", len(m3u8.Keys))
+	}
+	/*同一分片的多种KEYFORMAT中优先identity*/
+	key := m3u8.Keys[m3u8.Segments[0].KeyIndex]
+	if key.Method != CryptMethodSampleAES || key.URI != "key.bin" || !key.IsIdentity() || key.IV != "0x0102" {
+		t.Fatalf("expected identity SAMPLE-AES key, result: %+v", key)
+	}
+	key = m3u8.Keys[m3u8.Segments[1].KeyIndex]
+	if key.IsIdentity() || key.KeyFormat != "com.apple.streamingkeydelivery" {
+		t.Fatalf("expected DRM key format, result: %+v", key)
+	}
+
+	r := &Result{M3u8: m3u8, Keys: make(map[int]string)}
+	r.M3u8.Keys = map[int]*Key{1: key}
+	if err := r.fetchKeys(nil); err == nil || !strings.Contains(err.Error(), "com.apple.streamingkeydelivery") {
+		t.Fatalf("expected unsupported key format error, result: %v", err)
+	}
+
+	if _, err := parse(strings.NewReader("#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,URI=\"k\"\n")); err == nil {
+		t.Fatal("expected invalid method error")
+	}
+}
+
+func TestKeyIVBytes(t *testing.T) {
+	tests := []struct {
+		iv       string
+		sequence uint64
+		expected string
+	}{
+		{"0x0102030405060708090a0b0c0d0e0f10", 9, "0102030405060708090a0b0c0d0e0f10"},
+		{"0X1f", 9, "0000000000000000000000000000001f"},
+		{"", 258, "00000000000000000000000000000102"},
+	}
+	for _, test := range tests {
+		iv, err := (&Key{IV: test.iv}).IVBytes(test.sequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%x", iv); got != test.expected {
+			t.Fatalf("IV %q sequence %d: expected %s, result: %s", test.iv, test.sequence, test.expected, got)
+		}
+	}
+	for _, iv := range []string{"0xzz", "0x" + strings.Repeat("0", 33)} {
+		if _, err := (&Key{IV: iv}).IVBytes(0); err == nil {
+			t.Fatalf("expected error for IV %s", iv)
+		}
+	}
+}
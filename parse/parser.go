@@ -5,79 +5,200 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"strings"
 
 	"github.com/anlaneg/m3u8/tool"
 )
 
+var (
+	// ErrNoSegments is returned for media playlists without any segment
+	ErrNoSegments = errors.New("can not found any TS file description")
+	// ErrKeyFetch is wrapped by errors of getting a decryption key
+	ErrKeyFetch = errors.New("extract key failed")
+)
+
 type Result struct {
 	URL  *url.URL
 	M3u8 *M3u8
 	Keys map[int]string
+
+	opt *Options
+}
+
+// Options controls how FromURLWithOptions resolves a playlist
+type Options struct {
+	// Variant chosen when the URL points to a master playlist
+	Variant VariantSelector
+	// Client sends all playlist and key requests, tool.DefaultClient when nil
+	Client *tool.Client
+	// KeyProvider is consulted before a key URI is requested, may be nil
+	KeyProvider KeyProvider
+}
+
+// HTTPClient returns the client used for all requests
+func (o *Options) HTTPClient() *tool.Client {
+	if o == nil || o.Client == nil {
+		return tool.DefaultClient
+	}
+	return o.Client
 }
 
 /*解析url*/
 func FromURL(link string) (*Result, error) {
+	return FromURLWithOptions(link, nil)
+}
+
+// FromURLWithOptions requests and parses link, follows the variant chosen by
+// opt when link is a master playlist and fetches all decryption keys
+func FromURLWithOptions(link string, opt *Options) (*Result, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	/*执行m3u8内容解析，产生m3u8对象*/
+	result, err := Load(link, opt)
+	if err != nil {
+		return nil, err
+	}
+	m3u8 := result.M3u8
+
+	/*playlist不为空，按策略选取playlist,递归处理*/
+	if len(m3u8.MasterPlaylist) != 0 {
+		idx, err := opt.Variant.Select(m3u8.MasterPlaylist)
+		if err != nil {
+			return nil, err
+		}
+		sf := m3u8.MasterPlaylist[idx]
+		return FromURLWithOptions(tool.ResolveURL(result.URL, sf.URI), opt)
+	}
+
+	/*seg为空，报错*/
+	if len(m3u8.Segments) == 0 {
+		return nil, ErrNoSegments
+	}
+
+	if err := result.fetchKeys(nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Load requests and parses link only, master playlists are not followed and
+// no key is fetched
+func Load(link string, opt *Options) (*Result, error) {
 	u, err := url.Parse(link)
 	if err != nil {
 		/*uri有误*/
 		return nil, err
 	}
 	link = u.String()
-	body, err := tool.Get(link)
+	body, err := opt.HTTPClient().Get(link)
 	if err != nil {
-		return nil, fmt.Errorf("request m3u8 URL failed: %s", err.Error())
+		return nil, fmt.Errorf("request m3u8 URL failed: %w", err)
 	}
 	//noinspection GoUnhandledErrorResult
 	defer body.Close()
 
-	/*执行m3u8内容解析，产生m3u8对象*/
 	m3u8, err := parse(body)
 	if err != nil {
 		return nil, err
 	}
-
-	/*playlist不为空，取首个playlist,递归处理*/
-	if len(m3u8.MasterPlaylist) != 0 {
-		sf := m3u8.MasterPlaylist[0]
-		return FromURL(tool.ResolveURL(u, sf.URI))
-	}
-
-	/*seg为空，报错*/
-	if len(m3u8.Segments) == 0 {
-		return nil, errors.New("can not found any TS file description")
-	}
-
-	result := &Result{
+	return &Result{
 		URL:  u,                    /*uri*/
 		M3u8: m3u8,                 /*m3u8对象*/
 		Keys: make(map[int]string), /*对应的所有key*/
+		opt:  opt,
+	}, nil
+}
+
+// Reload requests the media playlist of r again, live and EVENT playlists grow
+// between two requests. Keys already fetched by r are reused.
+func Reload(r *Result) (*Result, error) {
+	result, err := Load(r.URL.String(), r.opt)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.M3u8.MasterPlaylist) != 0 {
+		return nil, fmt.Errorf("reload %s: master playlist is not expected", r.URL.String())
 	}
+	if err := result.fetchKeys(r); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
+/*获取m3u8中的所有key，prev中已获取过的key直接复用*/
+func (r *Result) fetchKeys(prev *Result) error {
 	/*遍历收集的所有key*/
-	for idx, key := range m3u8.Keys {
+	for idx, key := range r.M3u8.Keys {
 		switch {
 		case key.Method == "" || key.Method == CryptMethodNONE:
 			/*不加密，跳过key获取*/
 			continue
-		case key.Method == CryptMethodAES:
-			// Request URL to extract decryption key
-			keyURL := key.URI
-			keyURL = tool.ResolveURL(u, keyURL)
-			resp, err := tool.Get(keyURL)
-			if err != nil {
-				return nil, fmt.Errorf("extract key failed: %s", err.Error())
+		case !key.IsIdentity():
+			return fmt.Errorf("unsupported key format %s (%s): DRM protected streams can not be decrypted", key.KeyFormat, key.Method)
+		case key.Method == CryptMethodAES || key.Method == CryptMethodSampleAES:
+			if k, ok := prev.lookupKey(key); ok {
+				r.Keys[idx] = k
+				continue
 			}
-			keyByte, err := ioutil.ReadAll(resp)
-			_ = resp.Close()
+			keyByte, err := r.fetchKey(key)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			/*记录当前对应的key*/
-			fmt.Println("decryption key: ", string(keyByte))
-			result.Keys[idx] = string(keyByte)
+			tool.Log().Debug("decryption key fetched", "uri", key.URI, "key", keyByte)
+			r.Keys[idx] = string(keyByte)
 		default:
-			return nil, fmt.Errorf("unknown or unsupported cryption method: %s", key.Method)
+			return fmt.Errorf("unknown or unsupported cryption method: %s", key.Method)
 		}
 	}
-	return result, nil
+	return nil
+}
+
+/*依次尝试key provider、data URI与HTTP请求获取key*/
+func (r *Result) fetchKey(key *Key) ([]byte, error) {
+	keyURL := key.URI
+	if !strings.HasPrefix(keyURL, "data:") {
+		keyURL = tool.ResolveURL(r.URL, keyURL)
+	}
+	providers := KeyProviders{DataURIKeyProvider{}}
+	if r.opt != nil && r.opt.KeyProvider != nil {
+		providers = KeyProviders{r.opt.KeyProvider, DataURIKeyProvider{}}
+	}
+	value, ok, err := providers.Key(key, keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyFetch, err.Error())
+	}
+	if ok {
+		return value, nil
+	}
+
+	// Request URL to extract decryption key
+	resp, err := r.opt.HTTPClient().Get(keyURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyFetch, err.Error())
+	}
+	value, err = ioutil.ReadAll(resp)
+	_ = resp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyFetch, err.Error())
+	}
+	if len(value) != KeySize {
+		return nil, fmt.Errorf("%w: %s returned %d bytes, expected %d", ErrKeyFetch, keyURL, len(value), KeySize)
+	}
+	return value, nil
+}
+
+/*查找与key使用同一URI且已获取的key*/
+func (r *Result) lookupKey(key *Key) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for idx, k := range r.M3u8.Keys {
+		if k.Method == key.Method && k.URI == key.URI {
+			v, ok := r.Keys[idx]
+			return v, ok
+		}
+	}
+	return "", false
 }
@@ -0,0 +1,127 @@
+package parse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type VariantPolicy string
+
+const (
+	VariantFirst   VariantPolicy = "first"   // the first variant listed by the origin
+	VariantHighest VariantPolicy = "highest" // the highest BANDWIDTH
+	VariantLowest  VariantPolicy = "lowest"  // the lowest BANDWIDTH
+	VariantIndex   VariantPolicy = "index"   // VariantSelector.Index of the master playlist
+)
+
+// VariantSelector picks one variant out of a master playlist.
+// Its zero value selects the first variant.
+type VariantSelector struct {
+	Policy VariantPolicy
+	// Index into M3u8.MasterPlaylist, used by VariantIndex
+	Index int
+	// Variants with a RESOLUTION larger than WxH are skipped, e.g. 1280x720
+	MaxResolution string
+	// Only variants whose CODECS contains one codec starting with Codec are kept, e.g. avc1, hvc1
+	Codec string
+}
+
+// ParseVariantPolicy parses first, highest, lowest or a variant index
+func ParseVariantPolicy(s string) (VariantPolicy, int, error) {
+	switch p := VariantPolicy(strings.ToLower(s)); p {
+	case "", VariantFirst:
+		return VariantFirst, 0, nil
+	case VariantHighest, VariantLowest:
+		return p, 0, nil
+	}
+	idx, err := strconv.Atoi(s)
+	if err != nil || idx < 0 {
+		return "", 0, fmt.Errorf("invalid variant policy: %s", s)
+	}
+	return VariantIndex, idx, nil
+}
+
+// Select returns the index of the chosen variant in variants
+func (s *VariantSelector) Select(variants []*MasterPlaylist) (int, error) {
+	if len(variants) == 0 {
+		return -1, fmt.Errorf("no variant in master playlist")
+	}
+
+	/*按分辨率及codec过滤*/
+	maxW, maxH, err := parseResolution(s.MaxResolution)
+	if err != nil {
+		return -1, err
+	}
+	var candidates []int
+	for idx, v := range variants {
+		if s.MaxResolution != "" && v.Resolution != "" {
+			w, h, err := parseResolution(v.Resolution)
+			if err == nil && (w > maxW || h > maxH) {
+				continue
+			}
+		}
+		if s.Codec != "" && !hasCodec(v.Codecs, s.Codec) {
+			continue
+		}
+		candidates = append(candidates, idx)
+	}
+	if len(candidates) == 0 {
+		return -1, fmt.Errorf("no variant matches resolution '%s' and codec '%s'", s.MaxResolution, s.Codec)
+	}
+
+	switch s.Policy {
+	case "", VariantFirst:
+		return candidates[0], nil
+	case VariantIndex:
+		for _, idx := range candidates {
+			if idx == s.Index {
+				return idx, nil
+			}
+		}
+		return -1, fmt.Errorf("variant %d not found or filtered out (%d variants)", s.Index, len(variants))
+	case VariantHighest, VariantLowest:
+		chosen := candidates[0]
+		for _, idx := range candidates[1:] {
+			bw := variants[idx].BandWidth
+			if (s.Policy == VariantHighest && bw > variants[chosen].BandWidth) ||
+				(s.Policy == VariantLowest && bw < variants[chosen].BandWidth) {
+				chosen = idx
+			}
+		}
+		return chosen, nil
+	default:
+		return -1, fmt.Errorf("invalid variant policy: %s", s.Policy)
+	}
+}
+
+/*解析WxH格式的分辨率*/
+func parseResolution(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	split := strings.Split(strings.ToLower(s), "x")
+	if len(split) != 2 {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", s)
+	}
+	w, err := strconv.Atoi(split[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", s)
+	}
+	h, err := strconv.Atoi(split[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", s)
+	}
+	return w, h, nil
+}
+
+/*codecs中是否有以codec开头的项*/
+func hasCodec(codecs string, codec string) bool {
+	codec = strings.ToLower(codec)
+	for _, c := range strings.Split(codecs, ",") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(c)), codec) {
+			return true
+		}
+	}
+	return false
+}
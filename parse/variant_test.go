@@ -0,0 +1,63 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+)
+
+const masterPlaylist = `#EXTM3U
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+360p.m3u8
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS="hvc1.2.4.L123.B0,mp4a.40.2"
+1080p_hevc.m3u8
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.640028,mp4a.40.2"
+720p.m3u8
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=4000000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2"
+1080p.m3u8
+`
+
+func TestVariantSelector(t *testing.T) {
+	m3u8, err := parse(strings.NewReader(masterPlaylist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		selector VariantSelector
+		expected string
+	}{
+		{VariantSelector{}, "360p.m3u8"},
+		{VariantSelector{Policy: VariantHighest}, "1080p_hevc.m3u8"},
+		{VariantSelector{Policy: VariantLowest}, "360p.m3u8"},
+		{VariantSelector{Policy: VariantHighest, Codec: "avc1"}, "1080p.m3u8"},
+		{VariantSelector{Policy: VariantHighest, MaxResolution: "1280x720"}, "720p.m3u8"},
+		{VariantSelector{Policy: VariantIndex, Index: 2}, "720p.m3u8"},
+	}
+	for _, c := range cases {
+		idx, err := c.selector.Select(m3u8.MasterPlaylist)
+		if err != nil {
+			t.Fatalf("%+v: %s", c.selector, err)
+		}
+		if uri := m3u8.MasterPlaylist[idx].URI; uri != c.expected {
+			t.Fatalf("%+v: expected: %s, result: %s", c.selector, c.expected, uri)
+		}
+	}
+
+	if _, err := (&VariantSelector{Policy: VariantIndex, Index: 4}).Select(m3u8.MasterPlaylist); err == nil {
+		t.Fatal("expected error for out of range index")
+	}
+	if _, err := (&VariantSelector{Codec: "vp09"}).Select(m3u8.MasterPlaylist); err == nil {
+		t.Fatal("expected error when no codec matches")
+	}
+}
+
+func TestParseVariantPolicy(t *testing.T) {
+	if p, _, err := ParseVariantPolicy("Highest"); err != nil || p != VariantHighest {
+		t.Fatalf("expected: %s, result: %s, %v", VariantHighest, p, err)
+	}
+	if p, idx, err := ParseVariantPolicy("3"); err != nil || p != VariantIndex || idx != 3 {
+		t.Fatalf("expected: index 3, result: %s %d, %v", p, idx, err)
+	}
+	if _, _, err := ParseVariantPolicy("best"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,88 @@
+package tool
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+// LoadCookieJar reads a Netscape format cookie file (as exported by curl or browsers)
+func LoadCookieJar(path string) (http.CookieJar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := bufio.NewScanner(f)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimSpace(s.Text())
+		httpOnly := false
+		if strings.HasPrefix(line, httpOnlyPrefix) {
+			line = line[len(httpOnlyPrefix):]
+			httpOnly = true
+		}
+		/*忽略空行与注释*/
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		/*domain, include subdomains, path, secure, expires, name, value*/
+		fields := strings.Split(line, "\t")
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("invalid cookie line %d in %s", lineNo, path)
+		}
+		value := ""
+		if len(fields) > 6 {
+			value = fields[6]
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie expiry on line %d in %s", lineNo, path)
+		}
+		/*跳过已过期的cookie，0表示会话cookie*/
+		if expires != 0 && time.Unix(expires, 0).Before(now) {
+			continue
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+		secure := strings.EqualFold(fields[3], "TRUE")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    value,
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		if expires != 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: fields[2]}, []*http.Cookie{cookie})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
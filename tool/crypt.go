@@ -4,19 +4,28 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"fmt"
+	"io"
 )
 
+const decryptBufferSize = 32 * 1024
+
+/*IV必须为16字节，不能以key代替*/
+func errInvalidIV(iv []byte) error {
+	return fmt.Errorf("invalid IV length %d, expected %d bytes", len(iv), aes.BlockSize)
+}
+
 func AES128Encrypt(origData, key, iv []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	blockSize := block.BlockSize()
-	if len(iv) == 0 {
-		iv = key
+	if len(iv) != blockSize {
+		return nil, errInvalidIV(iv)
 	}
 	origData = pkcs5Padding(origData, blockSize)
-	blockMode := cipher.NewCBCEncrypter(block, iv[:blockSize])
+	blockMode := cipher.NewCBCEncrypter(block, iv)
 	crypted := make([]byte, len(origData))
 	blockMode.CryptBlocks(crypted, origData)
 	return crypted, nil
@@ -29,10 +38,10 @@ func AES128Decrypt(crypted, key, iv []byte) ([]byte, error) {
 		return nil, err
 	}
 	blockSize := block.BlockSize()
-	if len(iv) == 0 {
-		iv = key
+	if len(iv) != blockSize {
+		return nil, errInvalidIV(iv)
 	}
-	blockMode := cipher.NewCBCDecrypter(block, iv[:blockSize])
+	blockMode := cipher.NewCBCDecrypter(block, iv)
 	origData := make([]byte, len(crypted))
 	blockMode.CryptBlocks(origData, crypted)
 	origData = pkcs5UnPadding(origData)
@@ -50,3 +59,93 @@ func pkcs5UnPadding(origData []byte) []byte {
 	unPadding := int(origData[length-1])
 	return origData[:(length - unPadding)]
 }
+
+// NewAES128DecryptReader decrypts the AES-128-CBC stream r as it is read,
+// memory use does not depend on the stream length. The PKCS7 padding of
+// the last block is removed, a last block without valid padding is kept.
+func NewAES128DecryptReader(r io.Reader, key, iv []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errInvalidIV(iv)
+	}
+	return &cbcDecryptReader{
+		r:    r,
+		mode: cipher.NewCBCDecrypter(block, iv),
+		src:  make([]byte, 0, decryptBufferSize),
+		dst:  make([]byte, decryptBufferSize),
+	}, nil
+}
+
+type cbcDecryptReader struct {
+	r    io.Reader
+	mode cipher.BlockMode
+	src  []byte // crypted bytes not decrypted yet
+	dst  []byte
+	out  []byte // decrypted bytes not returned yet, backed by dst
+	err  error
+}
+
+func (c *cbcDecryptReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.fill()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+/*读入密文并解密，最后一个完整块留到读完后处理填充*/
+func (c *cbcDecryptReader) fill() {
+	n, err := c.r.Read(c.src[len(c.src):cap(c.src)])
+	c.src = c.src[:len(c.src)+n]
+	bs := c.mode.BlockSize()
+	if err == io.EOF {
+		if len(c.src)%bs != 0 {
+			c.err = fmt.Errorf("crypted data of %d trailing bytes is not a multiple of the block size", len(c.src))
+			return
+		}
+		c.mode.CryptBlocks(c.dst[:len(c.src)], c.src)
+		c.out = pkcs7UnPadding(c.dst[:len(c.src)], bs)
+		c.src = c.src[:0]
+		c.err = io.EOF
+		return
+	}
+	if err != nil {
+		c.err = err
+		return
+	}
+	k := len(c.src) / bs * bs
+	if len(c.src)%bs == 0 {
+		k -= bs
+	}
+	if k <= 0 {
+		return
+	}
+	c.mode.CryptBlocks(c.dst[:k], c.src[:k])
+	c.out = c.dst[:k]
+	c.src = c.src[:copy(c.src, c.src[k:])]
+}
+
+/*去除合法的PKCS7填充，非法时原样返回*/
+func pkcs7UnPadding(origData []byte, blockSize int) []byte {
+	length := len(origData)
+	if length == 0 {
+		return origData
+	}
+	padding := int(origData[length-1])
+	if padding == 0 || padding > blockSize || padding > length {
+		return origData
+	}
+	for _, b := range origData[length-padding:] {
+		if int(b) != padding {
+			return origData
+		}
+	}
+	return origData[:length-padding]
+}
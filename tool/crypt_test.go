@@ -1,7 +1,11 @@
 package tool
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"testing"
+	"testing/iotest"
 )
 
 func Test_AES128Encrypt_AND_AES128Decrypt(t *testing.T) {
@@ -21,3 +25,44 @@ func Test_AES128Encrypt_AND_AES128Decrypt(t *testing.T) {
 		t.Fatalf("expected: %s, result: %s", expected, de)
 	}
 }
+
+func TestAES128DecryptReader(t *testing.T) {
+	key := []byte("8dv4byf8b9e6bc1x")
+	iv := []byte("xduio1f8a12348u4")
+	for _, size := range []int{0, 1, 15, 16, 17, decryptBufferSize - 1, decryptBufferSize, 3*decryptBufferSize + 5} {
+		expected := make([]byte, size)
+		for i := range expected {
+			expected[i] = byte(i * 7)
+		}
+		encrypt, err := AES128Encrypt(append([]byte(nil), expected...), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []io.Reader{bytes.NewReader(encrypt), iotest.OneByteReader(bytes.NewReader(encrypt))} {
+			dr, err := NewAES128DecryptReader(r, key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(dr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Fatalf("size %d: decrypted %d bytes differ", size, len(got))
+			}
+		}
+	}
+
+	/*IV不能缺省为key*/
+	if _, err := NewAES128DecryptReader(bytes.NewReader(nil), key, nil); err == nil {
+		t.Fatal("expected invalid IV error")
+	}
+
+	dr, err := NewAES128DecryptReader(bytes.NewReader(make([]byte, 20)), key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(dr); err == nil {
+		t.Fatal("expected error on partial block")
+	}
+}
@@ -1,26 +1,296 @@
 package tool
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Client sends every request with the same headers and cookies over shared connections
+type Client struct {
+	// Header is added to every request, e.g. Referer, User-Agent, Authorization
+	Header http.Header
+	// Jar provides cookies, may be nil
+	Jar http.CookieJar
+	// Limiter limits the rate of reading response bodies, may be nil
+	Limiter *Limiter
+
+	transport http.RoundTripper
+}
+
+// DefaultClient is used by Get and GetRange
+var DefaultClient = &Client{}
+
 /*请求url*/
 func Get(url string) (io.ReadCloser, error) {
-	c := http.Client{
-		Timeout: time.Duration(30) * time.Second,
+	return DefaultClient.Get(url)
+}
+
+// GetRange requests a sub-range of url with DefaultClient
+func GetRange(url string, offset uint64, length uint64) (io.ReadCloser, error) {
+	return DefaultClient.GetRange(url, offset, length)
+}
+
+/*构造请求，带上公共header*/
+func (c *Client) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	resp, err := c.Get(url)
+	for name, values := range c.Header {
+		/*Host不能通过header设置*/
+		if http.CanonicalHeaderKey(name) == "Host" {
+			if len(values) > 0 {
+				req.Host = values[0]
+			}
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	transport := c.transport
+	if transport == nil {
+		transport = sharedTransport()
+	}
+	/*超时由transport按连接与读空闲时间控制，不限制总时长*/
+	hc := http.Client{
+		Transport: transport,
+		Jar:       c.Jar,
+	}
+	Log().Debug("http request", "url", req.URL.String(), "header", req.Header)
+	resp, err := hc.Do(req)
+	if err != nil {
+		/*url.Error中带有完整的URL，只记录其原因*/
+		cause := err
+		if urlErr, ok := err.(*neturl.Error); ok {
+			cause = urlErr.Err
+		}
+		Log().Debug("http request failed", "url", req.URL.String(), "error", cause)
+		return nil, err
+	}
+	Log().Debug("http response", "url", req.URL.String(), "status", resp.StatusCode, "content_length", resp.ContentLength)
+	return resp, nil
+}
+
+// HTTPStatusError is returned when the server answers with an unexpected status code
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	// RetryAfter is the delay asked by a Retry-After header, 0 if absent
+	RetryAfter time.Duration
+	// Size is the length of the resource given by the "bytes */<size>"
+	// Content-Range of a 416 answer, -1 if absent
+	Size int64
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http error: status code %d", e.StatusCode)
+}
+
+// Temporary reports whether the request may succeed later:
+// timeouts, rate limiting (429) and server errors (5xx)
+func (e *HTTPStatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+func newHTTPStatusError(url string, resp *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Size:       parseUnsatisfiedRange(resp),
+	}
+}
+
+/*416响应的Content-Range中资源的长度*/
+func parseUnsatisfiedRange(resp *http.Response) int64 {
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		return -1
+	}
+	cr := resp.Header.Get("Content-Range")
+	if !strings.HasPrefix(cr, "bytes */") {
+		return -1
+	}
+	size, err := strconv.ParseInt(cr[len("bytes */"):], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+/*Retry-After为秒数或HTTP日期*/
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Get requests url and returns its body, any status but 200 is an error
+func (c *Client) Get(url string) (io.ReadCloser, error) {
+	return c.GetContext(context.Background(), url)
+}
+
+// GetContext is Get aborted when ctx is done, including reading the body
+func (c *Client) GetContext(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
 		/*对端返回非200，执行报错*/
-		return nil, fmt.Errorf("http error: status code %d", resp.StatusCode)
+		_ = resp.Body.Close()
+		return nil, newHTTPStatusError(url, resp)
 	}
 
 	/*返回响应内容*/
+	return c.body(ctx, resp.Body), nil
+}
+
+// GetRange requests the sub-range [offset, offset+length) of url with a Range header.
+// Servers ignoring the header (200 instead of 206) are handled by skipping
+// offset bytes and reading at most length bytes of the whole body.
+func (c *Client) GetRange(url string, offset uint64, length uint64) (io.ReadCloser, error) {
+	return c.GetRangeContext(context.Background(), url, offset, length)
+}
+
+// GetRangeContext is GetRange aborted when ctx is done, including reading the body
+func (c *Client) GetRangeContext(ctx context.Context, url string, offset uint64, length uint64) (io.ReadCloser, error) {
+	resp, err := c.GetResumeContext(ctx, url, offset, length, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Offset != offset {
+		/*对端不支持Range，跳过offset字节*/
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(offset)); err != nil {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("skip %d bytes: %s", offset, err.Error())
+		}
+		return &limitedReadCloser{Reader: io.LimitReader(resp.Body, int64(length)), Closer: resp.Body}, nil
+	}
 	return resp.Body, nil
 }
+
+// RangeResponse is the response of GetResumeContext
+type RangeResponse struct {
+	Body io.ReadCloser
+	// Offset of the first byte of Body, 0 when the server sent the whole
+	// resource because it ignores Range or the If-Range validator failed
+	Offset uint64
+	// ETag and LastModified identify the version of the resource
+	ETag         string
+	LastModified string
+	// Length is the Content-Length of Body, -1 if unknown
+	Length int64
+}
+
+// Validator returns the If-Range value to resume this response later:
+// a strong ETag, or Last-Modified when there is none
+func (r *RangeResponse) Validator() string {
+	if r.ETag != "" && !strings.HasPrefix(r.ETag, "W/") {
+		return r.ETag
+	}
+	return r.LastModified
+}
+
+// GetResumeContext requests [offset, offset+length) of url, length 0 reads up to
+// the end of the resource. ifRange (an ETag or Last-Modified date) is sent as
+// If-Range so that a changed resource is sent whole instead of the range.
+func (c *Client) GetResumeContext(ctx context.Context, url string, offset uint64, length uint64, ifRange string) (*RangeResponse, error) {
+	req, err := c.newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 || length > 0 {
+		end := ""
+		if length > 0 {
+			end = strconv.FormatUint(offset+length-1, 10)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", offset, end))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RangeResponse{
+		Body:         c.body(ctx, resp.Body),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Length:       resp.ContentLength,
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		/*校验对端返回的区间起点*/
+		expected := fmt.Sprintf("bytes %d-", offset)
+		if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, expected) {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("http error: unexpected Content-Range '%s', requested offset %d", cr, offset)
+		}
+		r.Offset = offset
+		return r, nil
+	case http.StatusOK:
+		return r, nil
+	default:
+		/*对端返回非200/206，执行报错*/
+		_ = resp.Body.Close()
+		return nil, newHTTPStatusError(url, resp)
+	}
+}
+
+/*按Limiter限制读取响应的速率*/
+func (c *Client) body(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if c.Limiter == nil {
+		return body
+	}
+	return NewLimitedReader(ctx, body, c.Limiter)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ParseHeader parses "Name: value" lines into a header
+func ParseHeader(lines []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, line := range lines {
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid header '%s', expected 'Name: value'", line)
+		}
+		header.Add(strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:]))
+	}
+	return header, nil
+}
@@ -1,8 +1,16 @@
 package tool
 
 import (
+	"context"
+	"encoding/pem"
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestGet(t *testing.T) {
@@ -16,3 +24,144 @@ func TestGet(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestClientHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Referer() != "https://example.com/" || r.UserAgent() != "m3u8-test" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	header, err := ParseHeader([]string{"Referer: https://example.com/", "User-Agent:m3u8-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(srv.URL)
+	cookies := filepath.Join(t.TempDir(), "cookies.txt")
+	content := "# Netscape HTTP Cookie File\n" +
+		"#HttpOnly_" + u.Hostname() + "\tFALSE\t/\tFALSE\t0\tsession\tabc\n" +
+		u.Hostname() + "\tFALSE\t/\tFALSE\t1\texpired\tx\n"
+	if err := ioutil.WriteFile(cookies, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jar, err := LoadCookieJar(cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{Header: header, Jar: jar}
+	body, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if n := len(jar.Cookies(u)); n != 1 {
+		t.Fatalf("expected 1 cookie, result: %d", n)
+	}
+
+	if _, err := Get(srv.URL); err == nil {
+		t.Fatal("expected request without headers to be rejected")
+	}
+	if _, err := ParseHeader([]string{"no-colon"}); err == nil {
+		t.Fatal("expected invalid header error")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	/*未信任服务端证书时请求失败*/
+	c, err := NewClient(ClientConfig{ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(srv.URL); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewClient(ClientConfig{CAFile: ca, ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+
+	/*读空闲超时*/
+	body, err = c.Get(srv.URL + "/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Fatal("expected read timeout")
+	}
+	body.Close()
+
+	if _, err := NewClient(ClientConfig{Proxy: "ftp://127.0.0.1"}); err == nil {
+		t.Fatal("expected unsupported proxy error")
+	}
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	_, err := Get(srv.URL)
+	statusErr, ok := err.(*HTTPStatusError)
+	if !ok {
+		t.Fatalf("expected *HTTPStatusError, result: %v", err)
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests || statusErr.RetryAfter != 7*time.Second || !statusErr.Temporary() {
+		t.Fatalf("unexpected error %+v", statusErr)
+	}
+	if (&HTTPStatusError{StatusCode: http.StatusNotFound}).Temporary() {
+		t.Fatal("404 should not be temporary")
+	}
+	if statusErr.Size != -1 {
+		t.Fatalf("expected no size without 416, result: %d", statusErr.Size)
+	}
+
+	/*416时记录Content-Range中资源的长度*/
+	unsatisfied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes */1880")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer unsatisfied.Close()
+	_, err = DefaultClient.GetResumeContext(context.Background(), unsatisfied.URL, 1880, 0, "")
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusRequestedRangeNotSatisfiable || statusErr.Size != 1880 {
+		t.Fatalf("expected 416 with size 1880, result: %v", err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d := parseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now); d != 90*time.Second {
+		t.Fatalf("expected 90s from HTTP date, result: %s", d)
+	}
+	if d := parseRetryAfter("soon", now); d != 0 {
+		t.Fatalf("expected 0 for invalid value, result: %s", d)
+	}
+}
@@ -0,0 +1,141 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by all the readers it limits,
+// the rate can be changed while they are running
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second, 0 for unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second, 0 for unlimited
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	l.tokens = l.rate
+	return l
+}
+
+// SetRate changes the rate in bytes per second, 0 for unlimited
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = float64(rate)
+	/*允许最多1秒的突发*/
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = time.Now()
+}
+
+// Rate returns the rate in bytes per second, 0 for unlimited
+func (l *Limiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int64(l.rate)
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		l.lock.Lock()
+		if l.rate <= 0 {
+			l.lock.Unlock()
+			return nil
+		}
+		/*按流逝的时间补充令牌，不足时预支，等待至令牌恢复为0*/
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		l.last = now
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		take := float64(n)
+		if take > l.rate {
+			take = l.rate
+		}
+		l.tokens -= take
+		var wait time.Duration
+		if l.tokens < 0 {
+			wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+		l.lock.Unlock()
+
+		n -= int(take)
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return nil
+}
+
+// NewLimitedReader limits reading r by l
+func NewLimitedReader(ctx context.Context, r io.ReadCloser, l *Limiter) io.ReadCloser {
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+	l   *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if e := r.l.WaitN(r.ctx, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+func (r *limitedReader) Close() error {
+	return r.r.Close()
+}
+
+// ParseRate parses a rate in bytes per second such as 500K, 2M or 1.5G (1024 based),
+// an empty string is 0 (unlimited)
+func ParseRate(s string) (int64, error) {
+	v := strings.TrimSpace(s)
+	if v == "" {
+		return 0, nil
+	}
+	multiplier := 1.0
+	switch v[len(v)-1] {
+	case 'k', 'K':
+		multiplier = 1 << 10
+	case 'm', 'M':
+		multiplier = 1 << 20
+	case 'g', 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate '%s', expected bytes per second such as 500K or 2M", s)
+	}
+	return int64(f * multiplier), nil
+}
@@ -0,0 +1,60 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	for s, expected := range map[string]int64{"": 0, "512": 512, "500K": 500 << 10, "2M": 2 << 20, "1.5g": 3 << 29} {
+		if rate, err := ParseRate(s); err != nil || rate != expected {
+			t.Fatalf("%q: expected %d, result: %d %v", s, expected, rate, err)
+		}
+	}
+	if _, err := ParseRate("fast"); err == nil {
+		t.Fatal("expected invalid rate error")
+	}
+
+	/*两个reader共享100KB/s，首个1秒为突发，共300KB约需2秒*/
+	l := NewLimiter(100 << 10)
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r := NewLimitedReader(context.Background(), ioutil.NopCloser(bytes.NewReader(make([]byte, 150<<10))), l)
+			_, err := io.Copy(ioutil.Discard, r)
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 1800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("expected about 2s for 300KB at 100KB/s, result: %s", elapsed)
+	}
+
+	/*调整为不限速后立即完成*/
+	l.SetRate(0)
+	start = time.Now()
+	r := NewLimitedReader(context.Background(), ioutil.NopCloser(bytes.NewReader(make([]byte, 1<<20))), l)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected unlimited read, took %s", elapsed)
+	}
+
+	/*取消时停止等待*/
+	l.SetRate(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.WaitN(ctx, 100); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, result: %v", err)
+	}
+}
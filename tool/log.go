@@ -0,0 +1,227 @@
+package tool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log record, the values follow log/slog
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l <= LevelDebug:
+		return "DEBUG"
+	case l <= LevelInfo:
+		return "INFO"
+	case l <= LevelWarn:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// Logger writes leveled records with alternating key/value attributes,
+// e.g. Warn("segment failed", "segment", 3, "error", err)
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// LogOptions configures the logger returned by NewLogger
+type LogOptions struct {
+	// Level is the minimum level written
+	Level Level
+	// JSON writes one JSON object per line instead of text
+	JSON bool
+	// ShowSecrets disables the redaction of keys, cookies and auth headers,
+	// URL query strings (signed URLs carry tokens) and data: URIs (inline keys)
+	ShowSecrets bool
+}
+
+const redacted = "[REDACTED]"
+
+/*属性名或HTTP头名包含以下内容时按密文处理，覆盖X-Auth-Token、X-Api-Key等自定义头*/
+var secretNames = []string{"auth", "token", "key", "secret", "cookie", "session", "password", "credential"}
+
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range secretNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	loggerLock sync.RWMutex
+	logger     Logger = NewLogger(os.Stderr, LogOptions{Level: LevelInfo})
+)
+
+// SetLogger replaces the logger used by parse, dl and tool
+func SetLogger(l Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+}
+
+// Log returns the logger set by SetLogger, a text logger on stderr by default
+func Log() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+// NewLogger returns a logger writing to w
+func NewLogger(w io.Writer, opts LogOptions) Logger {
+	return &writerLogger{w: w, opts: opts}
+}
+
+type writerLogger struct {
+	lock sync.Mutex
+	w    io.Writer
+	opts LogOptions
+}
+
+func (l *writerLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *writerLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *writerLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *writerLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+func (l *writerLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.opts.Level {
+		return
+	}
+	now := time.Now()
+	var line []byte
+	if l.opts.JSON {
+		line = l.jsonLine(now, level, msg, args)
+	} else {
+		line = l.textLine(now, level, msg, args)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+/*time=... level=... msg=... k=v*/
+func (l *writerLogger) textLine(now time.Time, level Level, msg string, args []interface{}) []byte {
+	var b strings.Builder
+	b.WriteString(now.Format("2006-01-02T15:04:05.000"))
+	b.WriteString(" ")
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		name, value := l.attr(args, i)
+		s := fmt.Sprint(value)
+		if strings.ContainsAny(s, " \t\"=") || s == "" {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(" " + name + "=" + s)
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func (l *writerLogger) jsonLine(now time.Time, level Level, msg string, args []interface{}) []byte {
+	/*按固定顺序输出time、level、msg*/
+	fields := []string{
+		`"time":` + quoteJSON(now.Format(time.RFC3339Nano)),
+		`"level":` + quoteJSON(level.String()),
+		`"msg":` + quoteJSON(msg),
+	}
+	for i := 0; i < len(args); i += 2 {
+		name, value := l.attr(args, i)
+		b, err := json.Marshal(value)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(value))
+		}
+		fields = append(fields, quoteJSON(name)+":"+string(b))
+	}
+	return []byte("{" + strings.Join(fields, ",") + "}\n")
+}
+
+/*取出第i个属性，转换error/Stringer并处理需要隐藏的内容*/
+func (l *writerLogger) attr(args []interface{}, i int) (string, interface{}) {
+	name, ok := args[i].(string)
+	if !ok || i+1 >= len(args) {
+		return "!BADKEY", args[i]
+	}
+	value := args[i+1]
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case http.Header:
+		value = l.header(v)
+	case fmt.Stringer:
+		value = v.String()
+	case []byte:
+		value = string(v)
+	}
+	if !l.opts.ShowSecrets && isSecret(name) {
+		value = redacted
+	}
+	if s, ok := value.(string); ok && !l.opts.ShowSecrets && isURLName(name) {
+		value = redactURL(s)
+	}
+	return name, value
+}
+
+/*属性名为url、uri或以其结尾*/
+func isURLName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, "url") || strings.HasSuffix(name, "uri")
+}
+
+/*隐藏URL的query(签名URL中的token)及data URI的内容(内嵌的key)*/
+func redactURL(s string) string {
+	if strings.HasPrefix(strings.ToLower(s), "data:") {
+		return "data:" + redacted
+	}
+	if idx := strings.IndexByte(s, '?'); idx >= 0 {
+		return s[:idx+1] + redacted
+	}
+	return s
+}
+
+/*HTTP头按"Name: value"输出，敏感头隐藏*/
+func (l *writerLogger) header(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		for _, v := range h[name] {
+			if !l.opts.ShowSecrets && isSecret(name) {
+				v = redacted
+			}
+			lines = append(lines, name+": "+v)
+		}
+	}
+	return strings.Join(lines, "; ")
+}
+
+func quoteJSON(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,67 @@
+package tool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LogOptions{Level: LevelInfo})
+	l.Debug("hidden")
+	header := http.Header{"Authorization": {"Bearer abc"}, "Referer": {"https://example.com/"},
+		"X-Auth-Token": {"tok1"}, "X-Api-Key": {"apikey1"}, "Api-Key": {"apikey2"}, "X-Session-Id": {"sess1"}}
+	l.Warn("segment failed", "segment", 3, "error", errors.New("timeout"), "key", []byte("0123456789abcdef"), "header", header)
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Fatal("debug record written at info level")
+	}
+	for _, expected := range []string{" WARN segment failed", "segment=3", "error=timeout", "key=" + redacted, "Authorization: " + redacted, "Referer: https://example.com/"} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in %q", expected, out)
+		}
+	}
+	for _, secret := range []string{"0123456789abcdef", "Bearer", "tok1", "apikey1", "apikey2", "sess1"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("secret %q leaked: %q", secret, out)
+		}
+	}
+
+	buf.Reset()
+	l = NewLogger(&buf, LogOptions{Level: LevelDebug, JSON: true})
+	l.Debug("decryption key fetched", "uri", "k.key", "key", "secret")
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "DEBUG" || record["msg"] != "decryption key fetched" || record["uri"] != "k.key" || record["key"] != redacted {
+		t.Fatalf("unexpected JSON record: %v", record)
+	}
+
+	/*data URI中内嵌的key与签名URL的query*/
+	buf.Reset()
+	l = NewLogger(&buf, LogOptions{Level: LevelDebug})
+	l.Debug("decryption key fetched", "uri", "data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg==")
+	l.Debug("http request", "url", "https://example.com/0.ts?token=sig1&expires=1")
+	out = buf.String()
+	for _, expected := range []string{"uri=data:" + redacted, "url=https://example.com/0.ts?" + redacted} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in %q", expected, out)
+		}
+	}
+	for _, secret := range []string{"MDEyMzQ1Njc4OWFiY2RlZg", "sig1"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("secret %q leaked: %q", secret, out)
+		}
+	}
+	buf.Reset()
+	l = NewLogger(&buf, LogOptions{Level: LevelDebug, ShowSecrets: true})
+	l.Debug("http request", "url", "https://example.com/0.ts?token=sig1")
+	if !strings.Contains(buf.String(), "token=sig1") {
+		t.Fatalf("expected the query with ShowSecrets, result: %q", buf.String())
+	}
+}
@@ -0,0 +1,356 @@
+package tool
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/anlaneg/m3u8/ts"
+)
+
+// SAMPLE-AES encrypts the elementary streams inside the transport stream,
+// https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HLS_Sample_Encryption/
+const (
+	sampleAESClearLeader = 32  // clear bytes at the start of an H.264 NAL unit
+	sampleAESClearStride = 144 // clear bytes following each encrypted block
+	sampleAESMinNALSize  = 48  // shorter NAL units are not encrypted
+	sampleAESAACLeader   = 16  // clear bytes after the ADTS header
+)
+
+/*解密后改回明文的stream type*/
+var sampleAESStreamTypes = map[uint8]uint8{
+	ts.StreamTypeSampleAESH264: ts.StreamTypeH264,
+	ts.StreamTypeSampleAESAAC:  ts.StreamTypeAAC,
+}
+
+// NewSampleAESDecryptReader decrypts the SAMPLE-AES transport stream r as it is read.
+// H.264 slices and AAC frames are decrypted, the PMT is rewritten to the clear
+// stream types. Other streams, e.g. AC-3, are passed through unchanged.
+func NewSampleAESDecryptReader(r io.Reader, key, iv []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errInvalidIV(iv)
+	}
+	return &sampleAESReader{
+		r:       r,
+		block:   block,
+		iv:      iv,
+		pmtPIDs: make(map[uint16]bool),
+		streams: make(map[uint16]uint8),
+		pending: make(map[uint16][][]byte),
+		cc:      make(map[uint16]uint8),
+	}, nil
+}
+
+type sampleAESReader struct {
+	r     io.Reader
+	block cipher.Block
+	iv    []byte
+
+	pmtPIDs map[uint16]bool
+	streams map[uint16]uint8    // PID -> encrypted stream type
+	pending map[uint16][][]byte // packets of the PES not complete yet
+	cc      map[uint16]uint8    // next continuity counter of rewritten PIDs
+
+	out []byte // bytes not returned yet
+	err error
+}
+
+func (s *sampleAESReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.next()
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+/*处理一个packet，加密流的PES完整后解密并重新打包输出*/
+func (s *sampleAESReader) next() error {
+	b := make([]byte, ts.PacketSize)
+	n, err := io.ReadFull(s.r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		/*输出剩余的PES与不完整的packet*/
+		pids := make([]int, 0, len(s.pending))
+		for pid := range s.pending {
+			pids = append(pids, int(pid))
+		}
+		sort.Ints(pids)
+		for _, pid := range pids {
+			if err := s.flush(uint16(pid)); err != nil {
+				return err
+			}
+		}
+		s.out = append(s.out, b[:n]...)
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+
+	p, err := ts.ParsePacket(b)
+	if err != nil {
+		s.out = append(s.out, b...)
+		return nil
+	}
+	switch {
+	case p.PID == ts.PIDPAT && p.PayloadUnitStart:
+		if pids, err := ts.ParsePAT(p.Payload); err == nil {
+			for _, pid := range pids {
+				s.pmtPIDs[pid] = true
+			}
+		}
+	case s.pmtPIDs[p.PID] && p.PayloadUnitStart:
+		if streams, err := ts.ParsePMT(p.Payload); err == nil {
+			for _, stream := range streams {
+				if _, ok := sampleAESStreamTypes[stream.Type]; ok {
+					s.streams[stream.PID] = stream.Type
+				}
+			}
+			if err := ts.RewriteStreamTypes(p.Payload, sampleAESStreamTypes); err != nil {
+				return fmt.Errorf("rewrite PMT: %s", err.Error())
+			}
+		}
+	case s.streams[p.PID] != 0:
+		if p.PayloadUnitStart {
+			if err := s.flush(p.PID); err != nil {
+				return err
+			}
+			if _, ok := s.cc[p.PID]; !ok {
+				s.cc[p.PID] = p.ContinuityCounter
+			}
+			s.pending[p.PID] = [][]byte{b}
+			return nil
+		}
+		if _, ok := s.pending[p.PID]; ok {
+			s.pending[p.PID] = append(s.pending[p.PID], b)
+			return nil
+		}
+	}
+	s.out = append(s.out, b...)
+	return nil
+}
+
+/*解密pid上缓存的PES，按原packet的头部重新打包*/
+func (s *sampleAESReader) flush(pid uint16) error {
+	packets, ok := s.pending[pid]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, pid)
+
+	var pes []byte
+	for _, b := range packets {
+		p, _ := ts.ParsePacket(b)
+		pes = append(pes, p.Payload...)
+	}
+	_, offset, err := ts.ParsePESHeader(pes)
+	if err != nil {
+		/*无法解析的PES原样输出*/
+		for _, b := range packets {
+			s.out = append(s.out, b...)
+		}
+		return nil
+	}
+
+	var data []byte
+	switch s.streams[pid] {
+	case ts.StreamTypeSampleAESH264:
+		data = s.decryptH264(pes[offset:])
+	case ts.StreamTypeSampleAESAAC:
+		data = s.decryptAAC(pes[offset:])
+	}
+	pes = append(pes[:offset], data...)
+	/*PES_packet_length非0时按新长度更新*/
+	if pes[4] != 0 || pes[5] != 0 {
+		length := len(pes) - 6
+		pes[4], pes[5] = byte(length>>8), byte(length)
+	}
+
+	for _, b := range packets {
+		if len(pes) == 0 {
+			/*解密后数据变短，多余的packet丢弃*/
+			break
+		}
+		p, _ := ts.ParsePacket(b)
+		if len(p.Payload) == 0 {
+			/*不带payload的packet不增加continuity counter*/
+			packet := append([]byte(nil), b...)
+			packet[3] = packet[3]&0xf0 | (s.cc[pid]-1)&0x0f
+			s.out = append(s.out, packet...)
+			continue
+		}
+		header := b[:ts.PacketSize-len(p.Payload)]
+		if len(pes) < len(p.Payload) {
+			header = stuffHeader(header, len(pes))
+		}
+		n := ts.PacketSize - len(header)
+		packet := append(append([]byte(nil), header...), pes[:n]...)
+		packet[3] = packet[3]&0xf0 | s.cc[pid]&0x0f
+		s.cc[pid]++
+		s.out = append(s.out, packet...)
+		pes = pes[n:]
+	}
+	/*emulation prevention字节使解密后数据变长，追加packet*/
+	for len(pes) > 0 {
+		header := []byte{ts.SyncByte, byte(pid>>8) & 0x1f, byte(pid), 0x10}
+		if len(pes) < ts.PacketSize-len(header) {
+			header = stuffHeader(header, len(pes))
+		}
+		n := ts.PacketSize - len(header)
+		packet := append(header, pes[:n]...)
+		packet[3] = packet[3]&0xf0 | s.cc[pid]&0x0f
+		s.cc[pid]++
+		s.out = append(s.out, packet...)
+		pes = pes[n:]
+	}
+	return nil
+}
+
+/*扩展adaptation field填充，使packet只容纳n字节payload*/
+func stuffHeader(header []byte, n int) []byte {
+	length := ts.PacketSize - 4 - 1 - n // adaptation_field_length
+	h := append([]byte(nil), header[:4]...)
+	h[3] |= 0x20
+	var field []byte
+	if len(header) > 4 {
+		field = header[5:]
+	}
+	if len(field) == 0 && length > 0 {
+		/*flags全为0*/
+		field = []byte{0}
+	}
+	h = append(h, byte(length))
+	h = append(h, field...)
+	for len(h) < 5+length {
+		h = append(h, 0xff)
+	}
+	return h
+}
+
+/*解密一个access unit中的加密slice，解密后重新插入emulation prevention字节，避免出现伪start code*/
+func (s *sampleAESReader) decryptH264(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	starts := findStartCodes(data)
+	if len(starts) == 0 {
+		return data
+	}
+	out = append(out, data[:starts[0]]...)
+	for i, start := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		/*start code之后为NAL，末尾的0属于下一个4字节start code*/
+		begin := start + 3
+		stop := end
+		for stop > begin && data[stop-1] == 0 {
+			stop--
+		}
+		out = append(out, data[start:begin]...)
+		nal := data[begin:stop]
+		if len(nal) > sampleAESMinNALSize && (nal[0]&0x1f == 1 || nal[0]&0x1f == 5) {
+			nal = removeEmulationPrevention(nal)
+			s.decryptNAL(nal)
+			nal = addEmulationPrevention(nal)
+		}
+		out = append(out, nal...)
+		out = append(out, data[stop:end]...)
+	}
+	return out
+}
+
+/*前32字节明文，之后每16字节密文跟随最多144字节明文，每个NAL重新使用IV*/
+func (s *sampleAESReader) decryptNAL(nal []byte) {
+	mode := cipher.NewCBCDecrypter(s.block, s.iv)
+	for b := nal[sampleAESClearLeader:]; len(b) > aes.BlockSize; {
+		mode.CryptBlocks(b[:aes.BlockSize], b[:aes.BlockSize])
+		b = b[aes.BlockSize:]
+		if len(b) > sampleAESClearStride {
+			b = b[sampleAESClearStride:]
+		} else {
+			b = nil
+		}
+	}
+}
+
+/*解密PES中的所有ADTS帧: 帧头及其后16字节明文，其余完整的块为密文*/
+func (s *sampleAESReader) decryptAAC(data []byte) []byte {
+	for b := data; len(b) >= 7 && b[0] == 0xff && b[1]&0xf0 == 0xf0; {
+		frameLength := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+		headerLength := 7
+		if b[1]&0x01 == 0 {
+			/*protection_absent为0时带有CRC*/
+			headerLength = 9
+		}
+		if frameLength < headerLength || frameLength > len(b) {
+			break
+		}
+		frame := b[headerLength:frameLength]
+		if len(frame) > sampleAESAACLeader {
+			encrypted := frame[sampleAESAACLeader:]
+			encrypted = encrypted[:len(encrypted)/aes.BlockSize*aes.BlockSize]
+			cipher.NewCBCDecrypter(s.block, s.iv).CryptBlocks(encrypted, encrypted)
+		}
+		b = b[frameLength:]
+	}
+	return data
+}
+
+/*返回所有0x000001 start code的位置*/
+func findStartCodes(b []byte) []int {
+	var starts []int
+	for i := 0; i+3 <= len(b); i++ {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			starts = append(starts, i)
+			i += 2
+		}
+	}
+	return starts
+}
+
+/*去除0x000003中的0x03*/
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v == 3 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+/*在00 00之后的00-03前插入0x03，还原NAL的字节流格式*/
+func addEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/64)
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package tool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"testing"
+
+	"github.com/anlaneg/m3u8/ts"
+)
+
+// tsPackets packs payload into 188 bytes packets of pid, stuffing the last one
+func tsPackets(pid uint16, cc *uint8, payload []byte) []byte {
+	var out []byte
+	first := true
+	for len(payload) > 0 {
+		p := make([]byte, ts.PacketSize)
+		p[0] = ts.SyncByte
+		p[1] = byte(pid >> 8 & 0x1f)
+		if first {
+			p[1] |= 0x40
+		}
+		p[2] = byte(pid)
+		p[3] = 0x10 | *cc&0x0f
+		*cc++
+		n := len(payload)
+		if n < 184 {
+			p[3] |= 0x20
+			p[4] = byte(183 - n)
+			if n < 183 {
+				p[5] = 0
+				for i := 6; i < 188-n; i++ {
+					p[i] = 0xff
+				}
+			}
+		} else {
+			n = 184
+		}
+		copy(p[188-n:], payload[:n])
+		payload = payload[n:]
+		first = false
+		out = append(out, p...)
+	}
+	return out
+}
+
+func psiPayload(tableID byte, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(length>>8), byte(length), 0, 1, 0xc1, 0, 0}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0)
+}
+
+func pesPacket(streamID byte, bounded bool, data []byte) []byte {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5, 0x21, 0, 1, 0, 1}
+	if bounded {
+		length := 8 + len(data)
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	return append(header, data...)
+}
+
+func TestSampleAESDecryptReader(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	block, _ := aes.NewCipher(key)
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1e, 0x01}
+	var videoPlain, audioPlain [][]byte
+	var stream []byte
+	var patCC, pmtCC, videoCC, audioCC uint8
+	stream = append(stream, tsPackets(0, &patCC, psiPayload(0x00, []byte{0, 1, 0xe1, 0x00}))...)
+	stream = append(stream, tsPackets(0x100, &pmtCC, psiPayload(0x02, []byte{0xe1, 0x01, 0xf0, 0,
+		ts.StreamTypeSampleAESH264, 0xe1, 0x01, 0xf0, 0,
+		ts.StreamTypeSampleAESAAC, 0xe1, 0x02, 0xf0, 0}))...)
+	for i := 0; i < 3; i++ {
+		/*一个access unit: 明文的SPS与按模式加密的IDR slice，slice中的00 00 00 01需要emulation prevention*/
+		slice := []byte{0x65}
+		for j := 0; j < 500+i*37; j++ {
+			v := byte(j%250 + 1)
+			switch {
+			case j%97 < 3:
+				v = 0
+			case j%97 == 3:
+				v = 1
+			}
+			slice = append(slice, v)
+		}
+		plain := append([]byte{0, 0, 0, 1}, sps...)
+		plain = append(plain, 0, 0, 1)
+		plain = append(plain, addEmulationPrevention(slice)...)
+		videoPlain = append(videoPlain, plain)
+
+		encrypted := append([]byte(nil), slice...)
+		mode := cipher.NewCBCEncrypter(block, iv)
+		for b := encrypted[32:]; len(b) > 16; {
+			mode.CryptBlocks(b[:16], b[:16])
+			b = b[16:]
+			if len(b) > 144 {
+				b = b[144:]
+			} else {
+				b = nil
+			}
+		}
+		au := append([]byte{0, 0, 0, 1}, sps...)
+		au = append(au, 0, 0, 1)
+		au = append(au, addEmulationPrevention(encrypted)...)
+		stream = append(stream, tsPackets(0x101, &videoCC, pesPacket(0xe0, false, au))...)
+
+		/*ADTS帧: 头部及其后16字节明文，其余完整的块加密*/
+		frame := []byte{0xff, 0xf1, 0x50, 0x80, 0, 0, 0xfc}
+		length := 7 + 100
+		frame[3] |= byte(length >> 11 & 0x03)
+		frame[4] = byte(length >> 3)
+		frame[5] = byte(length<<5) | 0x1f
+		for j := 0; j < 100; j++ {
+			frame = append(frame, byte(j+i))
+		}
+		audioPlain = append(audioPlain, append([]byte(nil), frame...))
+		payload := frame[7+16 : 7+16+(100-16)/16*16]
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload, payload)
+		stream = append(stream, tsPackets(0x102, &audioCC, pesPacket(0xc0, true, frame))...)
+	}
+
+	r, err := NewSampleAESDecryptReader(bytes.NewReader(stream), key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, r); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len()%ts.PacketSize != 0 {
+		t.Fatalf("output of %d bytes is not made of whole packets", out.Len())
+	}
+
+	demuxer := ts.NewDemuxer(&out)
+	var video, audio [][]byte
+	for {
+		pes, err := demuxer.ReadPES()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch pes.StreamType {
+		case ts.StreamTypeH264:
+			video = append(video, pes.Data)
+		case ts.StreamTypeAAC:
+			audio = append(audio, pes.Data)
+		default:
+			t.Fatalf("unexpected stream type 0x%02x", pes.StreamType)
+		}
+	}
+	if len(video) != len(videoPlain) || len(audio) != len(audioPlain) {
+		t.Fatalf("expected %d video and %d audio PES, result: %d and %d",
+			len(videoPlain), len(audioPlain), len(video), len(audio))
+	}
+	for i := range video {
+		if !bytes.Equal(video[i], videoPlain[i]) {
+			t.Fatalf("video PES %d not decrypted", i)
+		}
+		if !bytes.Equal(audio[i], audioPlain[i]) {
+			t.Fatalf("audio PES %d not decrypted", i)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package tool
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ClientConfig configures the transport shared by all requests of a Client
+type ClientConfig struct {
+	// Proxy is an http://, https:// or socks5:// URL, the environment (HTTP_PROXY...) is used when empty
+	Proxy string
+	// ConnectTimeout limits establishing a connection, including the TLS handshake
+	ConnectTimeout time.Duration
+	// ReadTimeout limits the idle time waiting for response headers or body data,
+	// a large segment on a slow link may take any time as long as data keeps arriving
+	ReadTimeout time.Duration
+	// MaxIdleConnsPerHost keeps connections open for reuse by concurrent workers
+	MaxIdleConnsPerHost int
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and its key
+	CertFile string
+	KeyFile  string
+	// Insecure skips verification of server certificates
+	Insecure bool
+}
+
+// DefaultClientConfig is used by clients not created by NewClient
+var DefaultClientConfig = ClientConfig{
+	ConnectTimeout:      10 * time.Second,
+	ReadTimeout:         30 * time.Second,
+	MaxIdleConnsPerHost: 8,
+}
+
+var (
+	defaultTransportOnce sync.Once
+	defaultTransport     http.RoundTripper
+)
+
+// NewClient returns a client whose connections are shared by all its requests
+func NewClient(cfg ClientConfig) (*Client, error) {
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{transport: transport}, nil
+}
+
+/*未通过NewClient创建的client共用默认transport*/
+func sharedTransport() http.RoundTripper {
+	defaultTransportOnce.Do(func() {
+		t, err := newTransport(DefaultClientConfig)
+		if err != nil {
+			/*默认配置不涉及文件，不会失败*/
+			panic(err)
+		}
+		defaultTransport = t
+	})
+	return defaultTransport
+}
+
+func newTransport(cfg ClientConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %s", cfg.Proxy, err.Error())
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || cfg.ReadTimeout <= 0 {
+				return conn, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: cfg.ReadTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}, nil
+}
+
+func newTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %s", err.Error())
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %s", err.Error())
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+/*每次读之前重置deadline，只限制空闲时间而非总时长*/
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
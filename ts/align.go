@@ -0,0 +1,34 @@
+package ts
+
+import (
+	"bytes"
+	"io"
+)
+
+// NewSyncReader returns a reader that drops the bytes before the first sync byte of r.
+// Some segments do not start with 0x47 and can not be played after merging.
+func NewSyncReader(r io.Reader) io.Reader {
+	return &syncReader{r: r}
+}
+
+type syncReader struct {
+	r      io.Reader
+	synced bool
+}
+
+func (s *syncReader) Read(p []byte) (int, error) {
+	if s.synced || len(p) == 0 {
+		return s.r.Read(p)
+	}
+	for {
+		n, err := s.r.Read(p)
+		if i := bytes.IndexByte(p[:n], SyncByte); i >= 0 {
+			s.synced = true
+			return copy(p, p[i:n]), err
+		}
+		/*丢弃同步字节之前的内容*/
+		if err != nil {
+			return 0, err
+		}
+	}
+}
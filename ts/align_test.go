@@ -0,0 +1,20 @@
+package ts
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSyncReader(t *testing.T) {
+	packet := append([]byte{SyncByte}, bytes.Repeat([]byte{0xff}, PacketSize-1)...)
+	data := append([]byte{1, 2, 3}, packet...)
+	got, err := ioutil.ReadAll(NewSyncReader(iotest.OneByteReader(bytes.NewReader(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, packet) {
+		t.Fatalf("expected %d bytes starting at the sync byte, result: %d bytes", len(packet), len(got))
+	}
+}
@@ -0,0 +1,30 @@
+package ts
+
+// ContinuityChecker finds continuity_counter errors, i.e. packets lost or
+// reordered, in the packets of each PID
+type ContinuityChecker struct {
+	last map[uint16]uint8
+}
+
+// NewContinuityChecker returns a ContinuityChecker with no packet seen
+func NewContinuityChecker() *ContinuityChecker {
+	return &ContinuityChecker{last: make(map[uint16]uint8)}
+}
+
+// Check reports whether p follows the previous packet of its PID
+func (c *ContinuityChecker) Check(p *Packet) bool {
+	if p.PID == PIDNull {
+		return true
+	}
+	last, ok := c.last[p.PID]
+	c.last[p.PID] = p.ContinuityCounter
+	/*第一个packet及标记了discontinuity的packet重新开始计数*/
+	if !ok || p.Discontinuity {
+		return true
+	}
+	/*没有payload时计数不变，有payload时加1，允许重复发送一次*/
+	if p.ContinuityCounter == last {
+		return true
+	}
+	return p.HasPayload && p.ContinuityCounter == (last+1)&0x0f
+}
@@ -0,0 +1,32 @@
+package ts
+
+import (
+	"testing"
+)
+
+func TestContinuityChecker(t *testing.T) {
+	c := NewContinuityChecker()
+	for i, tc := range []struct {
+		packet   Packet
+		expected bool
+	}{
+		{Packet{PID: 0x100, ContinuityCounter: 15, HasPayload: true}, true},
+		{Packet{PID: 0x100, ContinuityCounter: 0, HasPayload: true}, true},
+		/*重复发送*/
+		{Packet{PID: 0x100, ContinuityCounter: 0, HasPayload: true}, true},
+		/*其他PID单独计数*/
+		{Packet{PID: 0x101, ContinuityCounter: 7, HasPayload: true}, true},
+		/*只有adaptation field时计数不变*/
+		{Packet{PID: 0x100, ContinuityCounter: 0, HasAdaptation: true}, true},
+		{Packet{PID: 0x100, ContinuityCounter: 1, HasAdaptation: true}, false},
+		/*丢失packet*/
+		{Packet{PID: 0x100, ContinuityCounter: 4, HasPayload: true}, false},
+		{Packet{PID: 0x100, ContinuityCounter: 5, HasPayload: true}, true},
+		{Packet{PID: 0x100, ContinuityCounter: 9, HasPayload: true, Discontinuity: true}, true},
+		{Packet{PID: PIDNull, ContinuityCounter: 3}, true},
+	} {
+		if got := c.Check(&tc.packet); got != tc.expected {
+			t.Fatalf("packet %d: expected %v, result: %v", i, tc.expected, got)
+		}
+	}
+}
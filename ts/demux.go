@@ -0,0 +1,166 @@
+package ts
+
+import (
+	"bufio"
+	"io"
+	"sort"
+)
+
+/*组装中的PES*/
+type pesBuffer struct {
+	length int // 6 + PES_packet_length, 0 when unbounded
+	data   []byte
+}
+
+// Demuxer reads complete PES packets of the streams listed in the PMT
+type Demuxer struct {
+	r       *bufio.Reader
+	buf     [PacketSize]byte
+	pmtPIDs map[uint16]bool
+	streams map[uint16]uint8
+	pending map[uint16]*pesBuffer
+	out     []*PES
+	eof     bool
+}
+
+// NewDemuxer returns a Demuxer reading transport stream packets from r
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:       bufio.NewReaderSize(r, 64*PacketSize),
+		pmtPIDs: make(map[uint16]bool),
+		streams: make(map[uint16]uint8),
+		pending: make(map[uint16]*pesBuffer),
+	}
+}
+
+// Streams returns the elementary streams found so far, keyed by PID
+func (d *Demuxer) Streams() map[uint16]uint8 {
+	return d.streams
+}
+
+// ReadPacket returns the next packet, bytes before a sync byte are skipped.
+// The packet is only valid until the next call.
+func (d *Demuxer) ReadPacket() (*Packet, error) {
+	for {
+		if _, err := io.ReadFull(d.r, d.buf[:1]); err != nil {
+			return nil, err
+		}
+		/*未对齐时逐字节查找sync byte*/
+		if d.buf[0] != SyncByte {
+			continue
+		}
+		if _, err := io.ReadFull(d.r, d.buf[1:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		p, err := ParsePacket(d.buf[:])
+		if err != nil {
+			continue
+		}
+		return p, nil
+	}
+}
+
+// ReadPES returns the next complete PES packet, io.EOF when the stream ends
+func (d *Demuxer) ReadPES() (*PES, error) {
+	for len(d.out) == 0 {
+		if d.eof {
+			return nil, io.EOF
+		}
+		p, err := d.ReadPacket()
+		if err == io.EOF {
+			d.eof = true
+			d.flush()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.handle(p)
+	}
+	pes := d.out[0]
+	d.out = d.out[1:]
+	return pes, nil
+}
+
+/*处理一个packet*/
+func (d *Demuxer) handle(p *Packet) {
+	if !p.HasPayload {
+		return
+	}
+	switch {
+	case p.PID == PIDPAT:
+		if !p.PayloadUnitStart {
+			return
+		}
+		if pids, err := ParsePAT(p.Payload); err == nil {
+			for _, pid := range pids {
+				d.pmtPIDs[pid] = true
+			}
+		}
+	case d.pmtPIDs[p.PID]:
+		if !p.PayloadUnitStart {
+			return
+		}
+		if streams, err := ParsePMT(p.Payload); err == nil {
+			for _, s := range streams {
+				d.streams[s.PID] = s.Type
+			}
+		}
+	default:
+		if _, ok := d.streams[p.PID]; !ok {
+			return
+		}
+		if p.PayloadUnitStart {
+			/*新的PES开始，前一个PES已完整*/
+			d.complete(p.PID)
+			buf := &pesBuffer{}
+			if len(p.Payload) >= 6 {
+				if l := int(p.Payload[4])<<8 | int(p.Payload[5]); l > 0 {
+					buf.length = 6 + l
+				}
+			}
+			d.pending[p.PID] = buf
+		}
+		buf, ok := d.pending[p.PID]
+		if !ok {
+			return
+		}
+		buf.data = append(buf.data, p.Payload...)
+		if buf.length > 0 && len(buf.data) >= buf.length {
+			buf.data = buf.data[:buf.length]
+			d.complete(p.PID)
+		}
+	}
+}
+
+/*pid上组装中的PES已完整，放入输出队列*/
+func (d *Demuxer) complete(pid uint16) {
+	buf, ok := d.pending[pid]
+	if !ok {
+		return
+	}
+	delete(d.pending, pid)
+	pes, offset, err := ParsePESHeader(buf.data)
+	if err != nil {
+		return
+	}
+	pes.PID = pid
+	pes.StreamType = d.streams[pid]
+	pes.Data = buf.data[offset:]
+	d.out = append(d.out, pes)
+}
+
+/*流结束，输出所有组装中的PES*/
+func (d *Demuxer) flush() {
+	pids := make([]int, 0, len(d.pending))
+	for pid := range d.pending {
+		pids = append(pids, int(pid))
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		d.complete(uint16(pid))
+	}
+}
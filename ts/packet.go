@@ -0,0 +1,61 @@
+// Package ts reads MPEG transport streams, https://en.wikipedia.org/wiki/MPEG_transport_stream
+package ts
+
+import (
+	"fmt"
+)
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+
+	PIDPAT  = 0x0000
+	PIDNull = 0x1fff
+)
+
+// Packet is a parsed 188 bytes transport stream packet, Payload refers to the packet bytes
+type Packet struct {
+	PID               uint16
+	PayloadUnitStart  bool
+	ContinuityCounter uint8
+	HasAdaptation     bool
+	HasPayload        bool
+	// discontinuity_indicator of the adaptation field
+	Discontinuity bool
+	Payload       []byte
+}
+
+// ParsePacket parses the 188 bytes packet b
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) != PacketSize {
+		return nil, fmt.Errorf("invalid packet size: %d", len(b))
+	}
+	if b[0] != SyncByte {
+		return nil, fmt.Errorf("invalid sync byte: 0x%02x", b[0])
+	}
+
+	p := &Packet{
+		PID:               uint16(b[1]&0x1f)<<8 | uint16(b[2]),
+		PayloadUnitStart:  b[1]&0x40 != 0,
+		HasAdaptation:     b[3]&0x20 != 0,
+		HasPayload:        b[3]&0x10 != 0,
+		ContinuityCounter: b[3] & 0x0f,
+	}
+
+	/*跳过adaptation field*/
+	offset := 4
+	if p.HasAdaptation {
+		length := int(b[4])
+		if 5+length > PacketSize {
+			return nil, fmt.Errorf("invalid adaptation field length: %d", length)
+		}
+		if length > 0 {
+			p.Discontinuity = b[5]&0x80 != 0
+		}
+		offset = 5 + length
+	}
+	if p.HasPayload {
+		p.Payload = b[offset:]
+	}
+	return p, nil
+}
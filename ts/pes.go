@@ -0,0 +1,46 @@
+package ts
+
+import (
+	"fmt"
+)
+
+// PES is a complete packetized elementary stream packet of one stream
+type PES struct {
+	PID        uint16
+	StreamType uint8
+	StreamID   uint8
+	HasPTS     bool
+	PTS        int64 // 90kHz
+	HasDTS     bool
+	DTS        int64 // 90kHz, equals PTS when absent
+	Data       []byte
+}
+
+// ParsePESHeader parses the header of the PES packet b and returns the offset of its payload
+func ParsePESHeader(b []byte) (*PES, int, error) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return nil, 0, fmt.Errorf("invalid PES start code")
+	}
+	pes := &PES{StreamID: b[3]}
+	headerLength := int(b[8])
+	if 9+headerLength > len(b) {
+		return nil, 0, fmt.Errorf("invalid PES header length: %d", headerLength)
+	}
+
+	flags := b[7] >> 6
+	if flags&0x02 != 0 && headerLength >= 5 {
+		pes.HasPTS = true
+		pes.PTS = parseTimestamp(b[9:14])
+		pes.DTS = pes.PTS
+	}
+	if flags == 0x03 && headerLength >= 10 {
+		pes.HasDTS = true
+		pes.DTS = parseTimestamp(b[14:19])
+	}
+	return pes, 9 + headerLength, nil
+}
+
+/*解析5字节的33位时间戳*/
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
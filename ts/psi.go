@@ -0,0 +1,146 @@
+package ts
+
+import (
+	"fmt"
+)
+
+// Stream types of the PMT
+const (
+	StreamTypeMPEG1Audio = 0x03
+	StreamTypeMPEG2Audio = 0x04
+	StreamTypeAAC        = 0x0f
+	StreamTypeH264       = 0x1b
+	StreamTypeH265       = 0x24
+	StreamTypeAC3        = 0x81
+
+	// SAMPLE-AES encrypted streams, https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HLS_Sample_Encryption/
+	StreamTypeSampleAESH264 = 0xdb
+	StreamTypeSampleAESAAC  = 0xcf
+	StreamTypeSampleAESAC3  = 0xc1
+)
+
+const (
+	tableIDPAT = 0x00
+	tableIDPMT = 0x02
+)
+
+// Stream is an elementary stream listed in the PMT
+type Stream struct {
+	PID  uint16
+	Type uint8
+}
+
+/*取出PSI payload中的section，跳过pointer_field*/
+func psiSection(payload []byte, tableID uint8) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty PSI payload")
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, fmt.Errorf("invalid pointer field: %d", pointer)
+	}
+	section := payload[1+pointer:]
+	if section[0] != tableID {
+		return nil, fmt.Errorf("unexpected table id 0x%02x, expected 0x%02x", section[0], tableID)
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) || length < 9 {
+		return nil, fmt.Errorf("invalid section length: %d", length)
+	}
+	/*去掉末尾的CRC32*/
+	return section[:3+length-4], nil
+}
+
+// ParsePAT returns the PMT PIDs listed in the PAT packet payload
+func ParsePAT(payload []byte) ([]uint16, error) {
+	section, err := psiSection(payload, tableIDPAT)
+	if err != nil {
+		return nil, err
+	}
+	var pids []uint16
+	for b := section[8:]; len(b) >= 4; b = b[4:] {
+		program := uint16(b[0])<<8 | uint16(b[1])
+		pid := uint16(b[2]&0x1f)<<8 | uint16(b[3])
+		/*program 0为network PID*/
+		if program != 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// ParsePMT returns the elementary streams listed in the PMT packet payload
+func ParsePMT(payload []byte) ([]Stream, error) {
+	section, err := psiSection(payload, tableIDPMT)
+	if err != nil {
+		return nil, err
+	}
+	if len(section) < 12 {
+		return nil, fmt.Errorf("invalid PMT length: %d", len(section))
+	}
+	infoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	if 12+infoLength > len(section) {
+		return nil, fmt.Errorf("invalid program info length: %d", infoLength)
+	}
+	var streams []Stream
+	for b := section[12+infoLength:]; len(b) >= 5; {
+		s := Stream{
+			Type: b[0],
+			PID:  uint16(b[1]&0x1f)<<8 | uint16(b[2]),
+		}
+		esInfoLength := int(b[3]&0x0f)<<8 | int(b[4])
+		if 5+esInfoLength > len(b) {
+			return nil, fmt.Errorf("invalid ES info length: %d", esInfoLength)
+		}
+		streams = append(streams, s)
+		b = b[5+esInfoLength:]
+	}
+	return streams, nil
+}
+
+// RewriteStreamTypes replaces the stream types of the PMT packet payload in place
+// according to types and updates the section CRC32. The PMT must fit in one packet.
+func RewriteStreamTypes(payload []byte, types map[uint8]uint8) error {
+	section, err := psiSection(payload, tableIDPMT)
+	if err != nil {
+		return err
+	}
+	if len(section) < 12 {
+		return fmt.Errorf("invalid PMT length: %d", len(section))
+	}
+	infoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	if 12+infoLength > len(section) {
+		return fmt.Errorf("invalid program info length: %d", infoLength)
+	}
+	for b := section[12+infoLength:]; len(b) >= 5; {
+		if t, ok := types[b[0]]; ok {
+			b[0] = t
+		}
+		esInfoLength := int(b[3]&0x0f)<<8 | int(b[4])
+		if 5+esInfoLength > len(b) {
+			return fmt.Errorf("invalid ES info length: %d", esInfoLength)
+		}
+		b = b[5+esInfoLength:]
+	}
+	/*section去掉了CRC，紧随其后的4字节即为CRC32*/
+	crc := crc32MPEG(section)
+	tail := section[len(section) : len(section)+4]
+	tail[0], tail[1], tail[2], tail[3] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	return nil
+}
+
+/*PSI使用的CRC-32/MPEG-2*/
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}